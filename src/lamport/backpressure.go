@@ -0,0 +1,132 @@
+package lamport
+
+import (
+	"fmt"
+	"log"
+)
+
+// ====================================
+//  Bounded links with backpressure
+// ====================================
+
+// A link may have a capacity, the number of messages it can hold in flight.
+// When a server sends on a full link, the simulator's policy decides what happens.
+// Only token messages are subject to the policy: markers and the other messages of
+// the snapshot algorithms are always blocked, never dropped, since losing one would
+// prevent the snapshot from completing.
+//
+// 有容量限制的信道，信道满时按照策略阻塞、丢弃或拒绝发送
+
+type FullLinkPolicy int
+
+const (
+	// The message waits at the sender until the link has room for it.
+	// The sender is debited right away and the messages keep the order they were sent in.
+	BlockWhenFull FullLinkPolicy = iota
+	// The message is lost, together with its tokens
+	DropWhenFull
+	// The send is rejected and the sender keeps its tokens
+	FailWhenFull
+)
+
+func (policy FullLinkPolicy) String() string {
+	switch policy {
+	case BlockWhenFull:
+		return "block"
+	case DropWhenFull:
+		return "drop"
+	case FailWhenFull:
+		return "fail"
+	}
+	return fmt.Sprintf("FullLinkPolicy(%d)", int(policy))
+}
+
+// Parse a full link policy from its name, e.g. "drop"
+func parseFullLinkPolicy(name string) (FullLinkPolicy, error) {
+	for _, policy := range []FullLinkPolicy{BlockWhenFull, DropWhenFull, FailWhenFull} {
+		if policy.String() == name {
+			return policy, nil
+		}
+	}
+	return BlockWhenFull, fmt.Errorf("unknown full link policy %q", name)
+}
+
+// A message that was dropped because the link was full
+type DroppedMessageEvent struct {
+	src     string
+	dest    string
+	message interface{}
+}
+
+func (m DroppedMessageEvent) String() string {
+	return fmt.Sprintf("%v dropped %v to %v: link full", m.src, m.message, m.dest)
+}
+
+// A message that waits at the sender because the link was full
+type BlockedMessageEvent struct {
+	src     string
+	dest    string
+	message interface{}
+}
+
+func (m BlockedMessageEvent) String() string {
+	return fmt.Sprintf("%v blocked %v to %v: link full", m.src, m.message, m.dest)
+}
+
+// A send of tokens that was rejected, because the link was full or the sender crashed
+type FailedSendEvent struct {
+	src       string
+	dest      string
+	numTokens int
+	reason    string
+}
+
+func (m FailedSendEvent) String() string {
+	return fmt.Sprintf("%v failed to send %v tokens to %v: %v", m.src, m.numTokens, m.dest, m.reason)
+}
+
+// Set the policy applied when a server sends tokens on a full link
+func (sim *Simulator) SetFullLinkPolicy(policy FullLinkPolicy) {
+	sim.fullLinkPolicy = policy
+}
+
+// Set the number of messages the link between two servers can hold, 0 = unbounded
+func (sim *Simulator) SetLinkCapacity(src string, dest string, capacity int) {
+	if capacity < 0 {
+		log.Fatalf("Invalid capacity %v for link %v -> %v\n", capacity, src, dest)
+	}
+	if capacity > 0 && sim.reliable {
+		log.Fatal("Reliable delivery is not available on bounded links")
+	}
+	sim.getLink(src, dest).capacity = capacity
+}
+
+// Whether any link has a capacity
+func (sim *Simulator) hasBoundedLink() bool {
+	for _, server := range sim.servers {
+		for _, link := range server.outboundLinks {
+			if link.capacity > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Whether a new message would have to wait before entering the link.
+// Messages already waiting go first, to keep the order they were sent in.
+func (link *Link) full() bool {
+	if !link.backlog.Empty() {
+		return true
+	}
+	return link.capacity > 0 && link.events.Len() >= link.capacity
+}
+
+// Move the oldest message waiting at the sender into the link, now that it has room.
+// Its delay starts when it enters the link.
+func (sim *Simulator) admitBacklog(link *Link) {
+	if link.backlog.Empty() {
+		return
+	}
+	sim.transmit(link, link.backlog.Pop().(SendMessageEvent).message)
+}
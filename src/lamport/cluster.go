@@ -0,0 +1,335 @@
+package lamport
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// =========
+//  Cluster
+// =========
+
+// A cluster runs every server of a topology as a node in its own process, on loopback
+// ports. Each process is started with the arguments "node <id> <tokens> <algorithm>"
+// and runs `ServeNode`, which prints the address of the node and the address of its
+// control port on the first line of its output. The launcher then sends commands to
+// every control port, one frame per command and per reply (see tcp.go):
+//
+//	link <dest> <addr>   add the outbound link to the node listening on addr
+//	inbound <src>        accept the link from src
+//	send <dest> <n>      send n tokens to dest
+//	snapshot <id>        start the snapshot of the given ID
+//	collect <id>         reply with the part of the snapshot recorded by the node, as a ".snap"
+//	quit                 stop the node
+//
+// Every other reply is "ok", or "error: " followed by the reason.
+//
+// 本地集群：每个服务器一个进程，通过控制端口回放事件并收集快照
+
+type Cluster struct {
+	// The topology, with the tokens every snapshot must add up to
+	sim *Simulator
+	// key = server ID, value = connection to the control port of its node
+	controls  map[string]net.Conn
+	processes []*exec.Cmd
+	// Wall-clock duration of a "tick"
+	unit           time.Duration
+	nextSnapshotId int
+}
+
+// Longest the launcher waits for a node process to print its addresses
+const startTimeout = 10 * time.Second
+
+// Start a process per server of the topology in the given ".top" file by running
+// the command followed by the arguments of the node, and wire the links between them
+func StartCluster(topFile string, algorithm SnapshotAlgorithm, unit time.Duration, command ...string) (*Cluster, error) {
+	b, err := ioutil.ReadFile(topFile)
+	if err != nil {
+		return nil, err
+	}
+	sim := NewSimulator(0)
+	parseTopology(string(b), sim)
+	cluster := &Cluster{sim, make(map[string]net.Conn), make([]*exec.Cmd, 0), unit, 0}
+	addrs := make(map[string]string)
+	for _, server := range sim.sortedServers() {
+		args := append(append([]string{}, command[1:]...),
+			"node", server.Id, strconv.Itoa(server.Tokens), algorithm.String())
+		addr, err := cluster.startNode(server.Id, exec.Command(command[0], args...))
+		if err != nil {
+			cluster.Close()
+			return nil, fmt.Errorf("server %v: %v", server.Id, err)
+		}
+		addrs[server.Id] = addr
+	}
+	for _, server := range sim.sortedServers() {
+		for _, dest := range server.getSortedLinks() {
+			if err := cluster.command(server.Id, "link", dest, addrs[dest]); err != nil {
+				cluster.Close()
+				return nil, err
+			}
+			if err := cluster.command(dest, "inbound", server.Id); err != nil {
+				cluster.Close()
+				return nil, err
+			}
+		}
+	}
+	return cluster, nil
+}
+
+// Start the process of a node and connect to its control port.
+// Return the address the node accepts the links on.
+func (cluster *Cluster) startNode(serverId string, cmd *exec.Cmd) (string, error) {
+	out := &firstLineWriter{line: make(chan string, 1)}
+	cmd.Stdout = out
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return "", err
+	}
+	addr, control, err := connectNode(out.line)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return "", err
+	}
+	cluster.processes = append(cluster.processes, cmd)
+	cluster.controls[serverId] = control
+	return addr, nil
+}
+
+// Read the addresses printed by the node and connect to its control port
+func connectNode(lines chan string) (string, net.Conn, error) {
+	var line string
+	select {
+	case line = <-lines:
+	case <-time.After(startTimeout):
+		return "", nil, fmt.Errorf("the node did not start")
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 2 {
+		return "", nil, fmt.Errorf("expected the addresses of the node, got %q", line)
+	}
+	control, err := net.Dial("tcp", fields[1])
+	if err != nil {
+		return "", nil, err
+	}
+	return fields[0], control, nil
+}
+
+// Passes on the first line of the output of a node, and discards the rest
+type firstLineWriter struct {
+	buf  []byte
+	line chan string
+	done bool
+}
+
+func (w *firstLineWriter) Write(p []byte) (int, error) {
+	if !w.done {
+		w.buf = append(w.buf, p...)
+		if i := bytes.IndexByte(w.buf, '\n'); i >= 0 {
+			w.line <- string(w.buf[:i])
+			w.done = true
+		}
+	}
+	return len(p), nil
+}
+
+// Send a command to the node of the given server and return its reply
+func (cluster *Cluster) request(serverId string, args ...string) (string, error) {
+	control, ok := cluster.controls[serverId]
+	if !ok {
+		return "", fmt.Errorf("unknown server %v", serverId)
+	}
+	if err := writeFrame(control, []byte(strings.Join(args, " "))); err != nil {
+		return "", err
+	}
+	reply, err := readFrame(control)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(string(reply), "error: ") {
+		return "", fmt.Errorf("server %v: %v", serverId, strings.TrimPrefix(string(reply), "error: "))
+	}
+	return string(reply), nil
+}
+
+func (cluster *Cluster) command(serverId string, args ...string) error {
+	_, err := cluster.request(serverId, args...)
+	return err
+}
+
+// Replay the "send", "snapshot" and "tick" events of the ".events" file on the
+// cluster and return the snapshots, once every node has completed them
+func (cluster *Cluster) Replay(eventsFile string) ([]*SnapshotState, error) {
+	b, err := ioutil.ReadFile(eventsFile)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int, 0)
+	for _, line := range strings.Split(string(b), "\n") {
+		parts := strings.Fields(line)
+		if len(parts) == 0 || strings.HasPrefix(parts[0], "#") {
+			continue
+		}
+		switch {
+		case parts[0] == "send" && len(parts) == 4:
+			err = cluster.command(parts[1], "send", parts[2], parts[3])
+		case parts[0] == "snapshot" && len(parts) == 2:
+			ids = append(ids, cluster.nextSnapshotId)
+			err = cluster.command(parts[1], "snapshot", strconv.Itoa(cluster.nextSnapshotId))
+			cluster.nextSnapshotId++
+		case parts[0] == "tick" && len(parts) <= 2:
+			numTicks := 1
+			if len(parts) == 2 {
+				numTicks, err = strconv.Atoi(parts[1])
+			}
+			time.Sleep(time.Duration(numTicks) * cluster.unit)
+		default:
+			err = fmt.Errorf("the cluster cannot replay %q", line)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	snapshots := make([]*SnapshotState, 0)
+	for _, id := range ids {
+		snap, err := cluster.CollectSnapshot(id)
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, snap)
+	}
+	return snapshots, nil
+}
+
+// Collect the parts of the snapshot from every node and merge them.
+// This function blocks until the snapshot process has completed on every node.
+func (cluster *Cluster) CollectSnapshot(snapshotId int) (*SnapshotState, error) {
+	parts := make([]*SnapshotState, 0)
+	for _, server := range cluster.sim.sortedServers() {
+		reply, err := cluster.request(server.Id, "collect", strconv.Itoa(snapshotId))
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, parseSnapshot(reply))
+	}
+	return MergeSnapshots(parts), nil
+}
+
+// The total number of tokens in the cluster, which every snapshot must add up to
+func (cluster *Cluster) Tokens() int {
+	return simulatorTokens(cluster.sim)
+}
+
+// Stop the nodes and wait for their processes to exit
+func (cluster *Cluster) Close() {
+	for serverId, control := range cluster.controls {
+		if err := cluster.command(serverId, "quit"); err != nil {
+			log.Printf("Server %v did not quit: %v\n", serverId, err)
+		}
+		control.Close()
+	}
+	for _, cmd := range cluster.processes {
+		if err := cmd.Wait(); err != nil {
+			log.Printf("%v: %v\n", cmd.Args, err)
+		}
+	}
+}
+
+// Write the snapshots to the directory as ".snap" files named after the ".events" file,
+// e.g. "8nodes-concurrent-snapshots0.snap"
+func WriteSnapshots(dir string, eventsFile string, snapshots []*SnapshotState) error {
+	name := strings.TrimSuffix(filepath.Base(eventsFile), filepath.Ext(eventsFile))
+	for _, snap := range snapshots {
+		fileName := filepath.Join(dir, fmt.Sprintf("%v%v.snap", name, snap.id))
+		if err := writeFileAtomic(fileName, []byte(formatSnapshot(snap))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run the node of a cluster: print the addresses of the node and of its control port
+// to out, then handle the commands of the launcher until it sends "quit"
+func ServeNode(id string, tokens int, algorithm SnapshotAlgorithm, out io.Writer) error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	node, err := NewNode(id, tokens, "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer node.Close()
+	node.SetAlgorithm(algorithm)
+	fmt.Fprintf(out, "%v %v\n", node.Addr(), listener.Addr())
+	control, err := listener.Accept()
+	if err != nil {
+		return err
+	}
+	defer control.Close()
+	for {
+		request, err := readFrame(control)
+		if err != nil {
+			return err
+		}
+		args := strings.Fields(string(request))
+		if len(args) == 1 && args[0] == "quit" {
+			return writeFrame(control, []byte("ok"))
+		}
+		reply, err := node.handleCommand(args)
+		if err != nil {
+			reply = "error: " + err.Error()
+		}
+		if err := writeFrame(control, []byte(reply)); err != nil {
+			return err
+		}
+	}
+}
+
+// Run a command of the launcher on the node
+func (node *Node) handleCommand(args []string) (string, error) {
+	if len(args) == 0 {
+		return "", fmt.Errorf("empty command")
+	}
+	switch {
+	case args[0] == "link" && len(args) == 3:
+		node.AddOutboundLink(args[1], args[2])
+	case args[0] == "inbound" && len(args) == 2:
+		node.AddInboundLink(args[1])
+	case args[0] == "send" && len(args) == 3:
+		numTokens, err := strconv.Atoi(args[2])
+		if err != nil {
+			return "", err
+		}
+		if tokens := node.Tokens(); tokens < numTokens {
+			return "", fmt.Errorf("cannot send %v tokens with %v", numTokens, tokens)
+		}
+		node.SendTokens(numTokens, args[1])
+	case args[0] == "snapshot" && len(args) == 2:
+		snapshotId, err := strconv.Atoi(args[1])
+		if err != nil {
+			return "", err
+		}
+		node.StartSnapshot(snapshotId)
+	case args[0] == "collect" && len(args) == 2:
+		snapshotId, err := strconv.Atoi(args[1])
+		if err != nil {
+			return "", err
+		}
+		return formatSnapshot(node.CollectSnapshot(snapshotId)), nil
+	default:
+		return "", fmt.Errorf("unknown command %q", strings.Join(args, " "))
+	}
+	return "ok", nil
+}
@@ -0,0 +1,659 @@
+package lamport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ============
+//  Wire codec
+// ============
+
+// Every message of the protocol has a binary form, used by the transports, and a
+// readable JSON form, e.g. for logs and for tools written in other languages.
+// Both start with the version of the codec, so a reader can reject the messages
+// it does not understand instead of misreading them. The binary form is
+//
+//	version  byte
+//	sender   string
+//	type     byte, see `messageTypes`
+//	snapshot varint, the ID of the snapshot the message belongs to, -1 if none
+//	payload  depending on the type
+//
+// where a string is its length as a uvarint followed by its bytes. The payload of
+// a packet of the reliable delivery layer and of a `SendMessageEvent` ends with the
+// message they carry, as type, snapshot and payload.
+//
+// 协议消息的二进制和 JSON 编码，带版本号，遇到未知版本时返回错误
+
+// The version written by this codec, the only one it reads
+const codecVersion = 1
+
+// Returned (wrapped) when decoding a message written by another version of the codec
+var ErrUnknownVersion = errors.New("unknown codec version")
+
+// The type tag of every message, in the binary form, and its name in the JSON form
+const (
+	tokenType byte = iota + 1
+	markerType
+	controlType
+	cutType
+	reportType
+	packetType
+	ackType
+	sendEventType
+	cutAckType
+	regionReportType
+	regionResultType
+)
+
+var messageTypes = map[byte]string{
+	tokenType:        "token",
+	markerType:       "marker",
+	controlType:      "control",
+	cutType:          "cut",
+	reportType:       "report",
+	packetType:       "packet",
+	ackType:          "ack",
+	sendEventType:    "send",
+	cutAckType:       "cutAck",
+	regionReportType: "regionReport",
+	regionResultType: "regionResult",
+}
+
+// Encode the message sent by the given server in the binary form.
+// A `SendMessageEvent` must be encoded with its source as the sender.
+func EncodeMessage(sender string, message interface{}) ([]byte, error) {
+	if err := checkSender(sender, message); err != nil {
+		return nil, err
+	}
+	w := &codecWriter{}
+	w.buf.WriteByte(codecVersion)
+	w.string(sender)
+	if err := w.body(message); err != nil {
+		return nil, err
+	}
+	return w.buf.Bytes(), nil
+}
+
+// Decode a message in the binary form, returning its sender
+func DecodeMessage(data []byte) (string, interface{}, error) {
+	r := &codecReader{data: data}
+	if version := r.byte(); r.err == nil && version != codecVersion {
+		return "", nil, fmt.Errorf("%w %v", ErrUnknownVersion, version)
+	}
+	sender := r.string()
+	message := r.body(sender)
+	if r.err == nil && len(r.data) > 0 {
+		r.err = fmt.Errorf("%v trailing bytes", len(r.data))
+	}
+	if r.err != nil {
+		return "", nil, r.err
+	}
+	return sender, message, nil
+}
+
+func checkSender(sender string, message interface{}) error {
+	if e, ok := message.(SendMessageEvent); ok && e.src != sender {
+		return fmt.Errorf("event sent by %v encoded as sent by %v", e.src, sender)
+	}
+	return nil
+}
+
+type codecWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *codecWriter) int(value int) {
+	b := make([]byte, binary.MaxVarintLen64)
+	w.buf.Write(b[:binary.PutVarint(b, int64(value))])
+}
+
+func (w *codecWriter) count(value int) {
+	b := make([]byte, binary.MaxVarintLen64)
+	w.buf.Write(b[:binary.PutUvarint(b, uint64(value))])
+}
+
+func (w *codecWriter) string(value string) {
+	w.count(len(value))
+	w.buf.WriteString(value)
+}
+
+func (w *codecWriter) strings(values []string) {
+	w.count(len(values))
+	for _, value := range values {
+		w.string(value)
+	}
+}
+
+// Write the type, snapshot and payload of the message
+func (w *codecWriter) body(message interface{}) error {
+	switch m := message.(type) {
+	case TokenMessage:
+		w.buf.WriteByte(tokenType)
+		w.int(-1)
+		w.int(m.numTokens)
+		w.count(len(m.recorded))
+		for _, id := range m.recorded {
+			w.int(id)
+		}
+		// In sorted order, so that a message always has the same encoding
+		keys := getSortedKeys(m.clock)
+		w.count(len(keys))
+		for _, serverId := range keys {
+			w.string(serverId)
+			w.int(m.clock[serverId])
+		}
+	case MarkerMessage:
+		w.buf.WriteByte(markerType)
+		w.int(m.snapshotId)
+		w.int(m.epoch)
+	case ControlMessage:
+		w.buf.WriteByte(controlType)
+		w.int(m.snapshotId)
+		w.int(m.numMessages)
+	case CutMessage:
+		w.buf.WriteByte(cutType)
+		w.int(m.cut.snapshotId)
+		w.string(m.cut.serverId)
+		w.int(m.cut.time)
+	case CutAckMessage:
+		w.buf.WriteByte(cutAckType)
+		w.int(m.snapshotId)
+		w.string(m.serverId)
+		w.strings(m.neighbors)
+		w.strings(m.route)
+	case SnapshotReportMessage:
+		w.buf.WriteByte(reportType)
+		w.int(m.snapshotId)
+		w.string(m.serverId)
+		w.strings(m.neighbors)
+		w.strings(m.route)
+	case RegionReportMessage:
+		w.buf.WriteByte(regionReportType)
+		w.int(m.snapshotId)
+		if err := w.state(m.state); err != nil {
+			return err
+		}
+		w.strings(m.route)
+	case RegionResultMessage:
+		w.buf.WriteByte(regionResultType)
+		w.int(m.snapshotId)
+		w.int(m.region)
+		w.count(len(m.states))
+		for _, state := range m.states {
+			if err := w.state(state); err != nil {
+				return err
+			}
+		}
+		w.strings(m.path)
+		w.strings(m.route)
+	case DataPacket:
+		w.buf.WriteByte(packetType)
+		w.int(codecSnapshotId(m.message))
+		w.int(m.seq)
+		return w.body(m.message)
+	case AckPacket:
+		w.buf.WriteByte(ackType)
+		w.int(-1)
+		w.int(m.next)
+	case SendMessageEvent:
+		w.buf.WriteByte(sendEventType)
+		w.int(codecSnapshotId(m.message))
+		w.string(m.dest)
+		w.int(m.receiveTime)
+		return w.body(m.message)
+	default:
+		return fmt.Errorf("cannot encode %v", message)
+	}
+	return nil
+}
+
+// Write the state of a server, its recorded messages as type, snapshot and payload
+func (w *codecWriter) state(state ServerState) error {
+	w.string(state.serverId)
+	w.int(state.region)
+	w.string(state.parent)
+	w.strings(state.neighbors)
+	keys := getSortedKeys(state.regions)
+	w.count(len(keys))
+	for _, serverId := range keys {
+		w.string(serverId)
+		w.int(state.regions[serverId])
+	}
+	w.int(state.tokens)
+	w.count(len(state.messages))
+	for _, message := range state.messages {
+		w.string(message.src)
+		w.string(message.dest)
+		if err := w.body(message.message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The snapshot a message belongs to, -1 if none
+func codecSnapshotId(message interface{}) int {
+	switch m := message.(type) {
+	case MarkerMessage, ControlMessage, CutMessage, CutAckMessage, SnapshotReportMessage,
+		RegionReportMessage, RegionResultMessage:
+		return snapshotIdOf(m)
+	case DataPacket:
+		return codecSnapshotId(m.message)
+	case SendMessageEvent:
+		return codecSnapshotId(m.message)
+	}
+	return -1
+}
+
+// Reads the binary form. The first error stops the reading,
+// every read after it returns a zero value.
+type codecReader struct {
+	data []byte
+	err  error
+}
+
+func (r *codecReader) fail(format string, args ...interface{}) {
+	if r.err == nil {
+		r.err = fmt.Errorf(format, args...)
+	}
+}
+
+func (r *codecReader) byte() byte {
+	if r.err != nil || len(r.data) == 0 {
+		r.fail("unexpected end of message")
+		return 0
+	}
+	b := r.data[0]
+	r.data = r.data[1:]
+	return b
+}
+
+func (r *codecReader) int() int {
+	if r.err != nil {
+		return 0
+	}
+	value, n := binary.Varint(r.data)
+	if n <= 0 {
+		r.fail("bad integer")
+		return 0
+	}
+	r.data = r.data[n:]
+	return int(value)
+}
+
+func (r *codecReader) count() int {
+	if r.err != nil {
+		return 0
+	}
+	value, n := binary.Uvarint(r.data)
+	if n <= 0 || value > uint64(len(r.data)) {
+		// Every element takes at least one byte
+		r.fail("bad length")
+		return 0
+	}
+	r.data = r.data[n:]
+	return int(value)
+}
+
+func (r *codecReader) string() string {
+	n := r.count()
+	if r.err != nil || n > len(r.data) {
+		r.fail("unexpected end of message")
+		return ""
+	}
+	value := string(r.data[:n])
+	r.data = r.data[n:]
+	return value
+}
+
+// Read a list of strings. An empty list is nil, as in the JSON form, e.g. the
+// neighbors of a server without outbound links or the route of a report on the tree
+func (r *codecReader) strings() []string {
+	n := r.count()
+	if n == 0 {
+		return nil
+	}
+	values := make([]string, n)
+	for i := range values {
+		values[i] = r.string()
+	}
+	return values
+}
+
+// Read the type, snapshot and payload of a message sent by the given server
+func (r *codecReader) body(sender string) interface{} {
+	messageType := r.byte()
+	snapshotId := r.int()
+	if r.err != nil {
+		return nil
+	}
+	switch messageType {
+	case tokenType:
+		message := TokenMessage{numTokens: r.int()}
+		if n := r.count(); n > 0 {
+			message.recorded = make([]int, n)
+			for i := range message.recorded {
+				message.recorded[i] = r.int()
+			}
+		}
+		if n := r.count(); n > 0 {
+			message.clock = make(map[string]int)
+			for i := 0; i < n; i++ {
+				serverId := r.string()
+				message.clock[serverId] = r.int()
+			}
+		}
+		return message
+	case markerType:
+		return MarkerMessage{snapshotId, r.int()}
+	case controlType:
+		return ControlMessage{snapshotId, r.int()}
+	case cutType:
+		return CutMessage{VectorCut{snapshotId, r.string(), r.int()}}
+	case cutAckType:
+		serverId := r.string()
+		neighbors := r.strings()
+		return CutAckMessage{snapshotId, serverId, neighbors, r.strings()}
+	case reportType:
+		serverId := r.string()
+		neighbors := r.strings()
+		return SnapshotReportMessage{snapshotId, serverId, neighbors, r.strings()}
+	case regionReportType:
+		state := r.state(sender)
+		return RegionReportMessage{snapshotId, state, r.strings()}
+	case regionResultType:
+		region := r.int()
+		var states []ServerState
+		if n := r.count(); n > 0 {
+			states = make([]ServerState, n)
+			for i := range states {
+				states[i] = r.state(sender)
+			}
+		}
+		path := r.strings()
+		return RegionResultMessage{snapshotId, region, states, path, r.strings()}
+	case packetType:
+		seq := r.int()
+		return DataPacket{seq, r.body(sender)}
+	case ackType:
+		return AckPacket{r.int()}
+	case sendEventType:
+		dest := r.string()
+		receiveTime := r.int()
+		return SendMessageEvent{sender, dest, r.body(sender), receiveTime}
+	}
+	r.fail("unknown message type %v", messageType)
+	return nil
+}
+
+// Read the state of a server in a message sent by the given server
+func (r *codecReader) state(sender string) ServerState {
+	state := ServerState{serverId: r.string(), region: r.int(), parent: r.string(), neighbors: r.strings()}
+	if n := r.count(); n > 0 {
+		state.regions = make(map[string]int)
+		for i := 0; i < n; i++ {
+			serverId := r.string()
+			state.regions[serverId] = r.int()
+		}
+	}
+	state.tokens = r.int()
+	if n := r.count(); n > 0 {
+		state.messages = make([]*SnapshotMessage, n)
+		for i := range state.messages {
+			src := r.string()
+			dest := r.string()
+			state.messages[i] = &SnapshotMessage{src, dest, r.body(sender)}
+		}
+	}
+	return state
+}
+
+// ===========
+//  JSON form
+// ===========
+
+// A message in the JSON form, e.g.
+//
+//	{"version":1,"type":"marker","snapshot":2,"sender":"N1","payload":{"epoch":7}}
+//
+// The message carried by a packet or a `SendMessageEvent` has neither version nor sender.
+type jsonMessage struct {
+	Version    int             `json:"version,omitempty"`
+	Type       string          `json:"type"`
+	SnapshotId int             `json:"snapshot"`
+	Sender     string          `json:"sender,omitempty"`
+	Payload    json.RawMessage `json:"payload"`
+}
+
+// The payloads of every type, only the fields of the type are set
+type jsonPayload struct {
+	NumTokens   int            `json:"tokens,omitempty"`
+	Recorded    []int          `json:"recorded,omitempty"`
+	Clock       map[string]int `json:"clock,omitempty"`
+	Epoch       int            `json:"epoch,omitempty"`
+	NumMessages int            `json:"messages,omitempty"`
+	ServerId    string         `json:"server,omitempty"`
+	Time        int            `json:"time,omitempty"`
+	Neighbors   []string       `json:"neighbors,omitempty"`
+	Route       []string       `json:"route,omitempty"`
+	Seq         int            `json:"seq,omitempty"`
+	Next        int            `json:"next,omitempty"`
+	Dest        string         `json:"dest,omitempty"`
+	ReceiveTime int            `json:"receiveTime,omitempty"`
+	Message     *jsonMessage   `json:"message,omitempty"`
+	Region      int            `json:"region,omitempty"`
+	State       *jsonState     `json:"state,omitempty"`
+	States      []jsonState    `json:"states,omitempty"`
+	Path        []string       `json:"path,omitempty"`
+}
+
+// The state of a server in the messages of merged snapshots
+type jsonState struct {
+	ServerId  string         `json:"server"`
+	Region    int            `json:"region"`
+	Parent    string         `json:"parent,omitempty"`
+	Neighbors []string       `json:"neighbors,omitempty"`
+	Regions   map[string]int `json:"regions,omitempty"`
+	Tokens    int            `json:"tokens,omitempty"`
+	Messages  []jsonRecorded `json:"messages,omitempty"`
+}
+
+// A message recorded in the state of a server
+type jsonRecorded struct {
+	Src     string       `json:"src"`
+	Dest    string       `json:"dest"`
+	Message *jsonMessage `json:"message"`
+}
+
+// Encode the message sent by the given server in the JSON form
+func EncodeMessageJSON(sender string, message interface{}) ([]byte, error) {
+	if err := checkSender(sender, message); err != nil {
+		return nil, err
+	}
+	j, err := toJSON(message)
+	if err != nil {
+		return nil, err
+	}
+	j.Version = codecVersion
+	j.Sender = sender
+	return json.Marshal(j)
+}
+
+// Decode a message in the JSON form, returning its sender
+func DecodeMessageJSON(data []byte) (string, interface{}, error) {
+	var j jsonMessage
+	if err := json.Unmarshal(data, &j); err != nil {
+		return "", nil, err
+	}
+	if j.Version != codecVersion {
+		return "", nil, fmt.Errorf("%w %v", ErrUnknownVersion, j.Version)
+	}
+	message, err := fromJSON(&j, j.Sender)
+	if err != nil {
+		return "", nil, err
+	}
+	return j.Sender, message, nil
+}
+
+func toJSON(message interface{}) (*jsonMessage, error) {
+	var p jsonPayload
+	var messageType byte
+	switch m := message.(type) {
+	case TokenMessage:
+		messageType = tokenType
+		p = jsonPayload{NumTokens: m.numTokens, Recorded: m.recorded, Clock: m.clock}
+	case MarkerMessage:
+		messageType = markerType
+		p = jsonPayload{Epoch: m.epoch}
+	case ControlMessage:
+		messageType = controlType
+		p = jsonPayload{NumMessages: m.numMessages}
+	case CutMessage:
+		messageType = cutType
+		p = jsonPayload{ServerId: m.cut.serverId, Time: m.cut.time}
+	case CutAckMessage:
+		messageType = cutAckType
+		p = jsonPayload{ServerId: m.serverId, Neighbors: m.neighbors, Route: m.route}
+	case SnapshotReportMessage:
+		messageType = reportType
+		p = jsonPayload{ServerId: m.serverId, Neighbors: m.neighbors, Route: m.route}
+	case RegionReportMessage:
+		state, err := stateToJSON(m.state)
+		if err != nil {
+			return nil, err
+		}
+		messageType = regionReportType
+		p = jsonPayload{State: state, Route: m.route}
+	case RegionResultMessage:
+		var states []jsonState
+		for _, state := range m.states {
+			j, err := stateToJSON(state)
+			if err != nil {
+				return nil, err
+			}
+			states = append(states, *j)
+		}
+		messageType = regionResultType
+		p = jsonPayload{Region: m.region, States: states, Path: m.path, Route: m.route}
+	case DataPacket:
+		inner, err := toJSON(m.message)
+		if err != nil {
+			return nil, err
+		}
+		messageType = packetType
+		p = jsonPayload{Seq: m.seq, Message: inner}
+	case AckPacket:
+		messageType = ackType
+		p = jsonPayload{Next: m.next}
+	case SendMessageEvent:
+		inner, err := toJSON(m.message)
+		if err != nil {
+			return nil, err
+		}
+		messageType = sendEventType
+		p = jsonPayload{Dest: m.dest, ReceiveTime: m.receiveTime, Message: inner}
+	default:
+		return nil, fmt.Errorf("cannot encode %v", message)
+	}
+	payload, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonMessage{
+		Type:       messageTypes[messageType],
+		SnapshotId: codecSnapshotId(message),
+		Payload:    payload}, nil
+}
+
+func fromJSON(j *jsonMessage, sender string) (interface{}, error) {
+	var p jsonPayload
+	if err := json.Unmarshal(j.Payload, &p); err != nil {
+		return nil, err
+	}
+	switch j.Type {
+	case messageTypes[tokenType]:
+		return TokenMessage{numTokens: p.NumTokens, recorded: p.Recorded, clock: p.Clock}, nil
+	case messageTypes[markerType]:
+		return MarkerMessage{j.SnapshotId, p.Epoch}, nil
+	case messageTypes[controlType]:
+		return ControlMessage{j.SnapshotId, p.NumMessages}, nil
+	case messageTypes[cutType]:
+		return CutMessage{VectorCut{j.SnapshotId, p.ServerId, p.Time}}, nil
+	case messageTypes[cutAckType]:
+		return CutAckMessage{j.SnapshotId, p.ServerId, p.Neighbors, p.Route}, nil
+	case messageTypes[reportType]:
+		return SnapshotReportMessage{j.SnapshotId, p.ServerId, p.Neighbors, p.Route}, nil
+	case messageTypes[regionReportType]:
+		if p.State == nil {
+			return nil, fmt.Errorf("%v without a state", j.Type)
+		}
+		state, err := stateFromJSON(p.State, sender)
+		if err != nil {
+			return nil, err
+		}
+		return RegionReportMessage{j.SnapshotId, state, p.Route}, nil
+	case messageTypes[regionResultType]:
+		var states []ServerState
+		for i := range p.States {
+			state, err := stateFromJSON(&p.States[i], sender)
+			if err != nil {
+				return nil, err
+			}
+			states = append(states, state)
+		}
+		return RegionResultMessage{j.SnapshotId, p.Region, states, p.Path, p.Route}, nil
+	case messageTypes[ackType]:
+		return AckPacket{p.Next}, nil
+	case messageTypes[packetType], messageTypes[sendEventType]:
+		if p.Message == nil {
+			return nil, fmt.Errorf("%v without a message", j.Type)
+		}
+		inner, err := fromJSON(p.Message, sender)
+		if err != nil {
+			return nil, err
+		}
+		if j.Type == messageTypes[packetType] {
+			return DataPacket{p.Seq, inner}, nil
+		}
+		return SendMessageEvent{sender, p.Dest, inner, p.ReceiveTime}, nil
+	}
+	return nil, fmt.Errorf("unknown message type %q", j.Type)
+}
+
+func stateToJSON(state ServerState) (*jsonState, error) {
+	j := jsonState{
+		ServerId:  state.serverId,
+		Region:    state.region,
+		Parent:    state.parent,
+		Neighbors: state.neighbors,
+		Regions:   state.regions,
+		Tokens:    state.tokens}
+	for _, message := range state.messages {
+		inner, err := toJSON(message.message)
+		if err != nil {
+			return nil, err
+		}
+		j.Messages = append(j.Messages, jsonRecorded{message.src, message.dest, inner})
+	}
+	return &j, nil
+}
+
+func stateFromJSON(j *jsonState, sender string) (ServerState, error) {
+	state := ServerState{j.ServerId, j.Region, j.Parent, j.Neighbors, j.Regions, j.Tokens, nil}
+	for _, recorded := range j.Messages {
+		if recorded.Message == nil {
+			return state, fmt.Errorf("recorded message without a message")
+		}
+		message, err := fromJSON(recorded.Message, sender)
+		if err != nil {
+			return state, err
+		}
+		state.messages = append(state.messages, &SnapshotMessage{recorded.Src, recorded.Dest, message})
+	}
+	return state, nil
+}
@@ -27,6 +27,11 @@ type SendMessageEvent struct {
 // This is expected to be encapsulated(封装) within a `sendMessageEvent`.
 type TokenMessage struct {
 	numTokens int
+	// Lai-Yang only: the snapshots in progress the sender had recorded when it sent the
+	// message. The message is "red" for these snapshots and "white" for all the others.
+	recorded []int
+	// Mattern only: the vector clock of the sender
+	clock map[string]int
 }
 
 func (m TokenMessage) String() string {
@@ -37,12 +42,116 @@ func (m TokenMessage) String() string {
 // This is expected to be encapsulated within a `sendMessageEvent`.
 type MarkerMessage struct {
 	snapshotId int
+	// The time step the snapshot was initiated at, used to merge concurrent snapshots
+	epoch int
 }
 
 func (m MarkerMessage) String() string {
 	return fmt.Sprintf("marker(%v)", m.snapshotId)
 }
 
+// A message sent on every outbound link when a server records its local state
+// in the counter based algorithms (Lai-Yang and Mattern), which do not need FIFO links.
+// Instead of delimiting the channel state by its position in the link, it carries
+// the number of token messages the sender sent on the link before recording.
+// This is expected to be encapsulated within a `sendMessageEvent`.
+type ControlMessage struct {
+	snapshotId  int
+	numMessages int
+}
+
+func (m ControlMessage) String() string {
+	return fmt.Sprintf("control(%v, %v)", m.snapshotId, m.numMessages)
+}
+
+// The cut of a snapshot in Mattern's algorithm: every event whose vector clock
+// has `clock[serverId] >= time` happened after the cut.
+type VectorCut struct {
+	snapshotId int
+	serverId   string // the initiator
+	time       int    // the initiator's clock when it records its local state, in its future when announced
+}
+
+// A message flooded by the initiator of a snapshot in Mattern's algorithm,
+// announcing the cut before any server passes it.
+// This is expected to be encapsulated within a `sendMessageEvent`.
+type CutMessage struct {
+	cut VectorCut
+}
+
+func (m CutMessage) String() string {
+	return fmt.Sprintf("cut(%v, %v@%v)", m.cut.snapshotId, m.cut.serverId, m.cut.time)
+}
+
+// A message sent towards the initiator in Mattern's algorithm once a server knows the cut,
+// along the same tree as a `SnapshotReportMessage`, see mattern.go.
+// This is expected to be encapsulated within a `sendMessageEvent`.
+type CutAckMessage struct {
+	snapshotId int
+	serverId   string
+	neighbors  []string // outbound neighbors of the acknowledging server
+	route      []string // servers a flooded ack went through, nil while it follows the tree
+}
+
+func (m CutAckMessage) String() string {
+	return fmt.Sprintf("cutAck(%v, %v)", m.snapshotId, m.serverId)
+}
+
+// A message sent towards the initiator by a server once a snapshot has completed locally,
+// used only when in-band termination detection is enabled, see termination.go.
+// This is expected to be encapsulated within a `sendMessageEvent`.
+type SnapshotReportMessage struct {
+	snapshotId int
+	serverId   string
+	neighbors  []string // outbound neighbors of the reporting server
+	route      []string // servers a flooded report went through, nil while it follows the tree
+}
+
+func (m SnapshotReportMessage) String() string {
+	return fmt.Sprintf("report(%v, %v)", m.snapshotId, m.serverId)
+}
+
+// The local state of a server in merged snapshots, gathered by the initiator of its region
+// and exchanged between the initiators, see merge.go.
+// A server that joined another region is reported with its region and parent only.
+type ServerState struct {
+	serverId  string
+	region    int            // the snapshot the server joined
+	parent    string         // the server the marker of the reported region came from, "" on its initiator
+	neighbors []string       // outbound neighbors
+	regions   map[string]int // inbound neighbors that joined another region, value = that region
+	tokens    int
+	messages  []*SnapshotMessage
+}
+
+// A message sent towards the initiator of a region of merged snapshots,
+// with the state of a server once its snapshot has completed locally, see merge.go.
+// This is expected to be encapsulated within a `sendMessageEvent`.
+type RegionReportMessage struct {
+	snapshotId int // the region
+	state      ServerState
+	route      []string // servers a flooded report went through, nil while it follows the tree
+}
+
+func (m RegionReportMessage) String() string {
+	return fmt.Sprintf("regionReport(%v, %v)", m.snapshotId, m.state.serverId)
+}
+
+// A message sent from the initiator of a region of merged snapshots to the initiator of
+// another one, with the states of every server of a region, see merge.go.
+// This is expected to be encapsulated within a `sendMessageEvent`.
+type RegionResultMessage struct {
+	snapshotId int // the region the message is sent to
+	region     int // the region of the states
+	states     []ServerState
+	path       []string // servers left to go through, down the tree of the sender's region
+	route      []string // servers a flooded result went through, nil while it follows the tree
+}
+
+func (m RegionResultMessage) String() string {
+	return fmt.Sprintf("regionResult(%v, %v)", m.snapshotId, m.region)
+}
+
 // =======================
 //  Events used by logger
 // =======================
@@ -61,6 +170,9 @@ func (m ReceivedMessageEvent) String() string {
 		return fmt.Sprintf("{ %v received %v tokens from %v }", m.dest, msg.numTokens, m.src)
 	case MarkerMessage:
 		return fmt.Sprintf("{ %v received marker(%v) from %v }", m.dest, msg.snapshotId, m.src)
+	case ControlMessage, CutMessage, CutAckMessage, SnapshotReportMessage,
+		RegionReportMessage, RegionResultMessage:
+		return fmt.Sprintf("{ %v received %v from %v }", m.dest, msg, m.src)
 	}
 	return fmt.Sprintf("{ Unrecognized message: %v }", m.message)
 }
@@ -79,6 +191,9 @@ func (m SentMessageEvent) String() string {
 		return fmt.Sprintf("%v sent %v tokens to %v \n", m.src, msg.numTokens, m.dest)
 	case MarkerMessage:
 		return fmt.Sprintf("%v sent marker(%v) to %v \n", m.src, msg.snapshotId, m.dest)
+	case ControlMessage, CutMessage, CutAckMessage, SnapshotReportMessage,
+		RegionReportMessage, RegionResultMessage:
+		return fmt.Sprintf("%v sent %v to %v \n", m.src, msg, m.dest)
 	}
 	return fmt.Sprintf("Unrecognized message: %v \n", m.message)
 }
@@ -135,6 +250,42 @@ type SnapshotState struct {
 	id       int
 	tokens   map[string]int // key = server ID, value = num tokens
 	messages []*SnapshotMessage
+	// The servers that had not completed the snapshot, nil unless it failed, see crash.go
+	missing []string
+}
+
+// The snapshot algorithm run by the servers of a simulator
+type SnapshotAlgorithm int
+
+const (
+	// Marker based, requires FIFO links (server.go)
+	ChandyLamport SnapshotAlgorithm = iota
+	// Message coloring with per link counters, works on non-FIFO links (laiyang.go)
+	LaiYang
+	// Vector clocks with per link counters, works on non-FIFO links (mattern.go)
+	Mattern
+)
+
+func (algorithm SnapshotAlgorithm) String() string {
+	switch algorithm {
+	case ChandyLamport:
+		return "chandy-lamport"
+	case LaiYang:
+		return "lai-yang"
+	case Mattern:
+		return "mattern"
+	}
+	return fmt.Sprintf("SnapshotAlgorithm(%d)", int(algorithm))
+}
+
+// Parse a snapshot algorithm from its name, e.g. "lai-yang"
+func ParseAlgorithm(name string) (SnapshotAlgorithm, error) {
+	for _, algorithm := range []SnapshotAlgorithm{ChandyLamport, LaiYang, Mattern} {
+		if algorithm.String() == name {
+			return algorithm, nil
+		}
+	}
+	return ChandyLamport, fmt.Errorf("unknown snapshot algorithm %q", name)
 }
 
 // =====================
@@ -0,0 +1,205 @@
+package lamport
+
+import (
+	"fmt"
+	"log"
+)
+
+// ======================
+//  Crash and recovery
+// ======================
+
+// A crashed server neither handles the messages that reach it nor sends any, until it
+// recovers with the state it had when it crashed. Depending on the simulator's policy,
+// the messages sent to a crashed server either wait on the links or are dropped.
+//
+// A crash fails every snapshot still in progress on the crashed server, as well as the
+// snapshots started while a server is down. A failed snapshot is collected with the
+// list of the servers that had not completed it, instead of blocking forever.
+//
+// 服务器崩溃与恢复，无法完成的快照被报告为失败，并列出缺失的服务器
+
+type CrashPolicy int
+
+const (
+	// The messages sent to a crashed server wait on the links until it recovers
+	BufferWhileCrashed CrashPolicy = iota
+	// The messages sent to a crashed server are dropped when they arrive
+	DropWhileCrashed
+)
+
+func (policy CrashPolicy) String() string {
+	switch policy {
+	case BufferWhileCrashed:
+		return "buffer"
+	case DropWhileCrashed:
+		return "drop"
+	}
+	return fmt.Sprintf("CrashPolicy(%d)", int(policy))
+}
+
+// Parse a crash policy from its name, e.g. "drop"
+func parseCrashPolicy(name string) (CrashPolicy, error) {
+	for _, policy := range []CrashPolicy{BufferWhileCrashed, DropWhileCrashed} {
+		if policy.String() == name {
+			return policy, nil
+		}
+	}
+	return BufferWhileCrashed, fmt.Errorf("unknown crash policy %q", name)
+}
+
+// An event parsed from the .events files that represents the crash of a server
+type CrashEvent struct {
+	serverId string
+}
+
+func (m CrashEvent) String() string {
+	return fmt.Sprintf("%v crashed", m.serverId)
+}
+
+// An event parsed from the .events files that represents the recovery of a server
+type RecoverEvent struct {
+	serverId string
+}
+
+func (m RecoverEvent) String() string {
+	return fmt.Sprintf("%v recovered", m.serverId)
+}
+
+// A message dropped because its destination was crashed
+type CrashDroppedEvent struct {
+	src     string
+	dest    string
+	message interface{}
+}
+
+func (m CrashDroppedEvent) String() string {
+	return fmt.Sprintf("%v dropped %v from %v: crashed", m.dest, m.message, m.src)
+}
+
+// A snapshot that could not complete because of a crash
+type SnapshotFailedEvent struct {
+	snapshotId int
+	missing    []string
+}
+
+func (m SnapshotFailedEvent) String() string {
+	return fmt.Sprintf("snapshot(%v) failed, missing %v", m.snapshotId, m.missing)
+}
+
+// Set what happens to the messages sent to a crashed server
+func (sim *Simulator) SetCrashPolicy(policy CrashPolicy) {
+	sim.crashPolicy = policy
+}
+
+// Crash the given server, failing the snapshots it has not completed
+func (sim *Simulator) CrashServer(serverId string) {
+	sim.requireSimulated("CrashServer")
+	server := sim.servers[serverId]
+	if server.crashed {
+		log.Fatalf("Server %v is already crashed\n", serverId)
+	}
+	sim.logger.RecordEvent(server, CrashEvent{serverId})
+	server.crashed = true
+	for _, progress := range sim.snapshotsInProgress() {
+		if progress.hasMember(serverId) && !server.completedSnapshot(progress) {
+			sim.failSnapshot(progress, server)
+		}
+	}
+}
+
+// Recover the given server with the state it had when it crashed
+func (sim *Simulator) RecoverServer(serverId string) {
+	sim.requireSimulated("RecoverServer")
+	server := sim.servers[serverId]
+	if !server.crashed {
+		log.Fatalf("Server %v is not crashed\n", serverId)
+	}
+	sim.logger.RecordEvent(server, RecoverEvent{serverId})
+	server.crashed = false
+	// The messages buffered on its links can be delivered again
+	for src := range server.inboundLinks {
+		sim.reschedule(sim.servers[src])
+	}
+}
+
+// Whether this server completed its part of the snapshot
+func (server *Server) completedSnapshot(progress *SnapshotProgress) bool {
+	local, ok := server.getMergedSnapshot(progress.ids)
+	return ok && local.complete
+}
+
+// Fail the snapshot because of the given server, unless it has already completed
+// or failed, waking up `CollectSnapshot` with the servers that had not completed it
+func (sim *Simulator) failSnapshot(progress *SnapshotProgress, cause *Server) {
+	if progress.finished >= 0 {
+		return
+	}
+	missing := make([]string, 0)
+	for _, server := range progress.members {
+		if !server.completedSnapshot(progress) {
+			missing = append(missing, server.Id)
+		}
+	}
+	progress.missing = missing
+	progress.finished = sim.time
+	for _, id := range progress.ids {
+		sim.logger.RecordEvent(cause, SnapshotFailedEvent{id, missing})
+	}
+	close(progress.done)
+}
+
+// Whether the message on the link can be handed to its destination now.
+// Under the drop policies, the messages that reach a crashed server or
+// cross a partition are dropped, see partition.go
+func (sim *Simulator) canDeliver(link *Link) bool {
+	if sim.servers[link.dest].crashed && sim.crashPolicy == BufferWhileCrashed {
+		return false
+	}
+	return !sim.crossesPartition(link) || sim.partitionPolicy == DropDuringPartition
+}
+
+// Whether nothing sent on the link can currently reach its destination
+func (sim *Simulator) isCutOff(link *Link) bool {
+	return sim.servers[link.dest].crashed || sim.crossesPartition(link)
+}
+
+// Drop the message that reached a crashed server
+func (sim *Simulator) dropAtCrashed(e SendMessageEvent) {
+	sim.countStats(func(stats *MessageStats) { stats.crashDropped++ })
+	sim.logger.RecordEvent(sim.servers[e.dest], CrashDroppedEvent{e.src, e.dest, e.message})
+	sim.uncountDroppedToken(e)
+}
+
+// Take a dropped token message back out of its sender's counter, so that the counter
+// based algorithms (laiyang.go) do not wait for it in the later snapshots. The snapshots
+// whose control message already counted it can no longer complete, so they fail.
+func (sim *Simulator) uncountDroppedToken(e SendMessageEvent) {
+	token, ok := e.message.(TokenMessage)
+	if !ok || sim.algorithm == ChandyLamport {
+		return
+	}
+	src := sim.servers[e.src]
+	dest := sim.servers[e.dest]
+	src.sent[e.dest]--
+	for _, progress := range sim.snapshotsInProgress() {
+		local, ok := src.getMergedSnapshot(progress.ids)
+		if ok && !src.isRed(token, local.id) && progress.hasMember(dest.Id) && !dest.completedSnapshot(progress) {
+			sim.failSnapshot(progress, dest)
+		}
+	}
+}
+
+// Return the failed snapshot, recording no state
+func (progress *SnapshotProgress) failedSnapshot(snapshotId int) *SnapshotState {
+	return &SnapshotState{
+		id:       snapshotId,
+		tokens:   make(map[string]int),
+		messages: make([]*SnapshotMessage, 0),
+		missing:  progress.missing}
+}
+
+// Whether the snapshot failed, in which case it records no state
+func (snap *SnapshotState) Failed() bool {
+	return snap.missing != nil
+}
@@ -0,0 +1,179 @@
+package lamport
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// ===============
+//  Delay models
+// ===============
+
+// How many time steps a message takes to travel on a link.
+// A simulator has a default model, which each link can override.
+// 消息在信道上传输需要的时间步数
+type DelayModel interface {
+	// Return the delay of the next message, at least 1,
+	// drawing any randomness from the simulator's generator
+	Delay(rng *rand.Rand) int
+	// Return the largest delay this model can return
+	MaxDelay() int
+}
+
+// Every message takes the same time
+type FixedDelay struct {
+	delay int
+}
+
+func NewFixedDelay(delay int) *FixedDelay {
+	return &FixedDelay{delay}
+}
+
+func (model *FixedDelay) Delay(rng *rand.Rand) int {
+	return model.delay
+}
+
+func (model *FixedDelay) MaxDelay() int {
+	return model.delay
+}
+
+// The delay is drawn uniformly from [min, max]
+type UniformDelay struct {
+	min int
+	max int
+}
+
+func NewUniformDelay(min int, max int) *UniformDelay {
+	return &UniformDelay{min, max}
+}
+
+func (model *UniformDelay) Delay(rng *rand.Rand) int {
+	return model.min + rng.Intn(model.max-model.min+1)
+}
+
+func (model *UniformDelay) MaxDelay() int {
+	return model.max
+}
+
+// The delay follows an exponential distribution with the given mean,
+// shifted by one time step and truncated at `max`
+type ExponentialDelay struct {
+	mean float64
+	max  int
+}
+
+func NewExponentialDelay(mean float64, max int) *ExponentialDelay {
+	return &ExponentialDelay{mean, max}
+}
+
+func (model *ExponentialDelay) Delay(rng *rand.Rand) int {
+	delay := 1 + int(math.Floor(rng.ExpFloat64()*model.mean))
+	if delay > model.max {
+		return model.max
+	}
+	return delay
+}
+
+func (model *ExponentialDelay) MaxDelay() int {
+	return model.max
+}
+
+// Most messages follow the fast model, a fraction of them the slow one (long tail)
+type BimodalDelay struct {
+	fast     DelayModel
+	slow     DelayModel
+	slowRate float64 // probability that a message takes the slow model
+}
+
+func NewBimodalDelay(fast DelayModel, slow DelayModel, slowRate float64) *BimodalDelay {
+	return &BimodalDelay{fast, slow, slowRate}
+}
+
+func (model *BimodalDelay) Delay(rng *rand.Rand) int {
+	if rng.Float64() < model.slowRate {
+		return model.slow.Delay(rng)
+	}
+	return model.fast.Delay(rng)
+}
+
+func (model *BimodalDelay) MaxDelay() int {
+	if model.slow.MaxDelay() > model.fast.MaxDelay() {
+		return model.slow.MaxDelay()
+	}
+	return model.fast.MaxDelay()
+}
+
+// Replay recorded delays in order, starting over once they run out
+type TraceDelay struct {
+	delays []int
+	next   int
+}
+
+// The trace must hold at least one delay
+func NewTraceDelay(delays []int) *TraceDelay {
+	if len(delays) == 0 {
+		log.Fatal("Cannot replay an empty trace of delays")
+	}
+	return &TraceDelay{delays, 0}
+}
+
+func (model *TraceDelay) Delay(rng *rand.Rand) int {
+	delay := model.delays[model.next]
+	model.next = (model.next + 1) % len(model.delays)
+	return delay
+}
+
+func (model *TraceDelay) MaxDelay() int {
+	max := 0
+	for _, delay := range model.delays {
+		if delay > max {
+			max = delay
+		}
+	}
+	return max
+}
+
+// Parse a delay model from its description in a ".top" file:
+// 	- "fixed:D"
+// 	- "uniform:MIN:MAX"
+// 	- "exponential:MEAN:MAX"
+// 	- "bimodal:FAST:SLOW:RATE", fixed fast and slow delays, a RATE (0 to 1) of the messages are slow
+// 	- "trace:D1,D2,..."
+// Messages are received at the earliest in the next time step, so every delay must be at least 1.
+func parseDelayModel(spec string) (DelayModel, error) {
+	parts := strings.Split(spec, ":")
+	if parts[0] == "trace" && len(parts) == 2 {
+		delays := make([]int, 0)
+		for _, field := range strings.Split(parts[1], ",") {
+			delay, err := strconv.Atoi(field)
+			if err != nil || delay < 1 {
+				return nil, fmt.Errorf("bad delay %q in delay model %q", field, spec)
+			}
+			delays = append(delays, delay)
+		}
+		return NewTraceDelay(delays), nil
+	}
+	args := make([]float64, 0)
+	for _, part := range parts[1:] {
+		arg, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad delay model %q: %v", spec, err)
+		}
+		args = append(args, arg)
+	}
+	switch {
+	case parts[0] == "fixed" && len(args) == 1 && args[0] >= 1:
+		return NewFixedDelay(int(args[0])), nil
+	case parts[0] == "uniform" && len(args) == 2 && args[0] >= 1 && args[1] >= args[0]:
+		return NewUniformDelay(int(args[0]), int(args[1])), nil
+	case parts[0] == "exponential" && len(args) == 2 && args[0] > 0 && args[1] >= 1:
+		return NewExponentialDelay(args[0], int(args[1])), nil
+	case parts[0] == "bimodal" && len(args) == 3 && args[0] >= 1 && args[1] >= 1 && args[2] >= 0 && args[2] <= 1:
+		return NewBimodalDelay(NewFixedDelay(int(args[0])), NewFixedDelay(int(args[1])), args[2]), nil
+	}
+	return nil, fmt.Errorf("bad delay model %q", spec)
+}
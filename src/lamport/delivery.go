@@ -0,0 +1,136 @@
+package lamport
+
+import (
+	"fmt"
+)
+
+// =====================
+//  Delivery policies
+// =====================
+
+// At each time step, the servers with a message ready on one of their outbound links
+// are visited in sorted order. The delivery policy decides which ready messages
+// each of them hands to their destinations.
+//
+// 投递策略：决定每个时间步每个服务器投递哪些已就绪的消息
+
+type DeliveryPolicy int
+
+const (
+	// At most one message per source server, from its first ready link in sorted order.
+	// This establishes a total ordering of packet delivery to each server.
+	FirstReadyLink DeliveryPolicy = iota
+	// At most one message per source server, from its first ready link
+	// after the one it delivered from last, in sorted order
+	RoundRobinLinks
+	// Every ready message
+	AllReady
+	// At most one message per source server, from one of its ready links chosen at random
+	RandomLink
+	// At most one message per link, and at most one message per destination server
+	OnePerDestination
+)
+
+func (policy DeliveryPolicy) String() string {
+	switch policy {
+	case FirstReadyLink:
+		return "first-ready"
+	case RoundRobinLinks:
+		return "round-robin"
+	case AllReady:
+		return "all-ready"
+	case RandomLink:
+		return "random"
+	case OnePerDestination:
+		return "one-per-destination"
+	}
+	return fmt.Sprintf("DeliveryPolicy(%d)", int(policy))
+}
+
+// Parse a delivery policy from its name, e.g. "round-robin"
+func parseDeliveryPolicy(name string) (DeliveryPolicy, error) {
+	for _, policy := range []DeliveryPolicy{FirstReadyLink, RoundRobinLinks, AllReady, RandomLink, OnePerDestination} {
+		if policy.String() == name {
+			return policy, nil
+		}
+	}
+	return FirstReadyLink, fmt.Errorf("unknown delivery policy %q", name)
+}
+
+// Choose which ready messages are delivered at each time step.
+// The policy is recorded in the header of the log.
+func (sim *Simulator) SetDeliveryPolicy(policy DeliveryPolicy) {
+	sim.deliveryPolicy = policy
+	sim.logger.SetHeader("Delivery", policy.String())
+}
+
+// Deliver the ready messages of the server according to the delivery policy.
+// `received` holds the destinations that received a message at this time step.
+func (sim *Simulator) deliverFrom(server *Server, received map[string]bool) {
+	ready := make([]*Link, 0)
+	for _, dest := range server.getSortedLinks() { //获得该服务器的外向信道的目的地
+		link := server.outboundLinks[dest] //获得该服务器到dest的外向信道
+		// The destination may be crashed or across a partition
+		if sim.canDeliver(link) && link.hasReady(sim.time) {
+			ready = append(ready, link)
+		}
+	}
+	if len(ready) == 0 {
+		return
+	}
+	switch sim.deliveryPolicy {
+	case FirstReadyLink:
+		sim.deliverOne(ready[0])
+	case RoundRobinLinks:
+		next := ready[0]
+		for _, link := range ready {
+			if link.dest > server.lastDelivered {
+				next = link
+				break
+			}
+		}
+		server.lastDelivered = next.dest
+		sim.deliverOne(next)
+	case AllReady:
+		for _, link := range ready {
+			for sim.deliverOne(link) {
+			}
+		}
+	case RandomLink:
+		sim.deliverOne(ready[sim.rng.Intn(len(ready))])
+	case OnePerDestination:
+		for _, link := range ready {
+			if !received[link.dest] && sim.deliverOne(link) {
+				received[link.dest] = true
+			}
+		}
+	}
+}
+
+// Deliver the next ready message of the link, if any.
+// Which message is ready depends on the order of the link.
+func (sim *Simulator) deliverOne(link *Link) bool {
+	e, ok := link.popReady(sim.time, sim.rng)
+	if !ok {
+		return false
+	}
+	if sim.servers[e.dest].crashed {
+		sim.dropAtCrashed(e)
+	} else if sim.crossesPartition(link) {
+		sim.dropAtPartition(e)
+	} else if packet, ok := e.message.(DataPacket); ok {
+		// Numbered by the reliable delivery layer, see reliable.go
+		sim.servers[e.dest].receivePacket(link, packet)
+	} else {
+		sim.deliver(e.src, sim.servers[e.dest], e.message)
+	}
+	// The link has room for a message blocked at the sender, see backpressure.go
+	sim.admitBacklog(link)
+	return true
+}
+
+// Whether a queued message can be delivered at the given time
+func (link *Link) hasReady(time int) bool {
+	next, ok := link.nextReceiveTime()
+	return ok && next <= time
+}
@@ -0,0 +1,87 @@
+package lamport
+
+import (
+	"fmt"
+	"log"
+)
+
+// ==================
+//  Fault injection
+// ==================
+
+// A link may lose or duplicate the messages put on it, each with a given probability.
+// Chandy-Lamport and the other algorithms assume reliable links, so faulty links are
+// meant to be used together with the reliable delivery layer, see reliable.go
+//
+// 信道故障注入：按概率丢失或重复消息
+
+// A message that was lost on the link
+type LostMessageEvent struct {
+	src     string
+	dest    string
+	message interface{}
+}
+
+func (m LostMessageEvent) String() string {
+	return fmt.Sprintf("%v lost %v to %v", m.src, m.message, m.dest)
+}
+
+// A message that the link delivers twice
+type DuplicatedMessageEvent struct {
+	src     string
+	dest    string
+	message interface{}
+}
+
+func (m DuplicatedMessageEvent) String() string {
+	return fmt.Sprintf("%v duplicated %v to %v", m.src, m.message, m.dest)
+}
+
+// Set the probability that the link between two servers loses a message
+func (sim *Simulator) SetLinkLoss(src string, dest string, probability float64) {
+	// A link that loses everything would retransmit forever
+	if probability < 0 || probability >= 1 {
+		log.Fatalf("Invalid loss probability %v for link %v -> %v\n", probability, src, dest)
+	}
+	sim.getLink(src, dest).loss = probability
+}
+
+// Set the probability that the link between two servers duplicates a message
+func (sim *Simulator) SetLinkDuplication(src string, dest string, probability float64) {
+	if probability < 0 || probability > 1 {
+		log.Fatalf("Invalid duplication probability %v for link %v -> %v\n", probability, src, dest)
+	}
+	sim.getLink(src, dest).dup = probability
+}
+
+// Whether the next message put on the link is lost.
+// The generator is only drawn from on faulty links, so that runs without faults
+// are the same as before faults existed.
+func (sim *Simulator) isLost(link *Link) bool {
+	return link.loss > 0 && sim.rng.Float64() < link.loss
+}
+
+// Whether the message put on its link is lost, recording the loss
+func (sim *Simulator) lose(link *Link, e SendMessageEvent) bool {
+	if !sim.isLost(link) {
+		return false
+	}
+	sim.countStats(func(stats *MessageStats) { stats.lost++ })
+	sim.logger.RecordEvent(sim.servers[e.src], LostMessageEvent{e.src, e.dest, e.message})
+	return true
+}
+
+// Put a second copy of the message on its link, with a receive time of its own,
+// if the link duplicates it
+func (sim *Simulator) duplicate(link *Link, e SendMessageEvent) {
+	if link.dup <= 0 || sim.rng.Float64() >= link.dup {
+		return
+	}
+	src := sim.servers[e.src]
+	sim.countStats(func(stats *MessageStats) { stats.duplicated++ })
+	sim.logger.RecordEvent(src, DuplicatedMessageEvent{e.src, e.dest, e.message})
+	again := e
+	again.receiveTime = sim.GetReceiveTime(link)
+	link.events.Push(again)
+	sim.schedule(src, again.receiveTime)
+}
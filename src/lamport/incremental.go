@@ -0,0 +1,83 @@
+package lamport
+
+import "log"
+
+// ==========================
+//  Incremental snapshots
+// ==========================
+
+// With periodic snapshots most servers often have the same local state as in the
+// previous snapshot. With `sim.SetIncrementalSnapshots(true)` a server only reports
+// its local state when it changed since the last snapshot completed on that server
+// (the base). The simulator rebuilds the full state of a server by following the
+// chain of bases back to a snapshot where the server reported its state.
+// The channel state is always reported in full.
+//
+// 增量快照：服务器只上报和上一个快照相比发生变化的本地状态
+
+// The part of a snapshot that changed since the previous snapshots
+type SnapshotDelta struct {
+	id       int
+	tokens   map[string]int // key = server ID, only the servers whose state changed
+	bases    map[string]int // key = server ID, value = snapshot the server's state is the same as
+	messages []*SnapshotMessage
+}
+
+// Only report the local state of a server when it changed since its last snapshot.
+// This must be called before any snapshot starts.
+func (sim *Simulator) SetIncrementalSnapshots(enabled bool) {
+	sim.incremental = enabled
+}
+
+// Collect the compact delta of a snapshot from all the servers.
+// This function blocks until the snapshot process has completed on all servers.
+func (sim *Simulator) CollectSnapshotDelta(snapshotId int) *SnapshotDelta {
+	if delta, ok := sim.deltas.Load(snapshotId); ok {
+		return delta.(*SnapshotDelta)
+	}
+	progress := sim.getSnapshotProgress(snapshotId)
+	<-progress.done
+	delta := SnapshotDelta{
+		snapshotId,
+		make(map[string]int),
+		make(map[string]int),
+		make([]*SnapshotMessage, 0)}
+	for _, server := range progress.members {
+		serverId := server.Id
+		local, ok := server.getMergedSnapshot(progress.ids)
+		if progress.missing != nil && (!ok || !local.complete) {
+			// A failed snapshot only serves as the base of the servers that completed it
+			continue
+		}
+		if !ok {
+			log.Fatalf("Server %v did not record snapshot %v\n", serverId, snapshotId)
+		}
+		if sim.incremental && local.unchanged {
+			delta.bases[serverId] = local.base
+		} else {
+			delta.tokens[serverId] = local.tokens
+		}
+		delta.messages = append(delta.messages, local.messages...)
+	}
+	sim.deltas.Store(snapshotId, &delta)
+	return &delta
+}
+
+// Rebuild the full snapshot state from a delta and the chain of its bases
+func (sim *Simulator) expandSnapshot(delta *SnapshotDelta) *SnapshotState {
+	snap := SnapshotState{id: delta.id, tokens: make(map[string]int), messages: delta.messages}
+	for serverId, tokens := range delta.tokens {
+		snap.tokens[serverId] = tokens
+	}
+	for serverId, base := range delta.bases {
+		for {
+			baseDelta := sim.CollectSnapshotDelta(base)
+			if tokens, ok := baseDelta.tokens[serverId]; ok {
+				snap.tokens[serverId] = tokens
+				break
+			}
+			base = baseDelta.bases[serverId]
+		}
+	}
+	return &snap
+}
@@ -0,0 +1,122 @@
+package lamport
+
+import "log"
+
+// ===================================
+//  Lai-Yang snapshot algorithm
+// ===================================
+
+// Chandy-lamport relies on FIFO links: the marker separates the messages sent
+// before the sender recorded its state from the ones sent after. Lai-Yang
+// instead colors every token message. A message is "white" for a snapshot if the
+// sender had not recorded its local state for it yet, and "red" otherwise
+// (`TokenMessage.recorded`). Then for every snapshot:
+//
+//  - A server records its local state when the snapshot is initiated on it, when
+//    it receives a control message, or right before it handles a red message.
+//  - The channel state of a link is the white messages received after recording.
+//  - Recording on a link stops once all the white messages sent on it have been
+//    received. The sender tells how many there are in the `ControlMessage` it sends
+//    when it records its state, so the links do not need to be FIFO.
+//
+// 在非FIFO信道上也能得到一致的快照
+
+// Send a control message carrying the number of token messages sent so far on every outbound link
+func (server *Server) sendControlMessages(snapshotId int) {
+	for _, serverId := range server.getSortedLinks() {
+		link := server.outboundLinks[serverId]
+		message := ControlMessage{snapshotId, server.sent[link.dest]}
+		server.sim.logger.RecordEvent(server, SentMessageEvent{server.Id, link.dest, message})
+		server.send(link, message)
+	}
+}
+
+// Return the snapshots this server has recorded that are still in progress, in recording
+// order. Once a snapshot has completed or failed, every member has recorded its local state
+// or never will, so the messages no longer need its color and only carry the newer ones.
+func (server *Server) recordedInProgress() []int {
+	var ids []int
+	for _, snapshotId := range server.recorded {
+		progress := server.sim.getSnapshotProgress(snapshotId)
+		server.sim.lock.Lock()
+		finished := progress.finished
+		server.sim.lock.Unlock()
+		if finished < 0 {
+			ids = append(ids, snapshotId)
+		}
+	}
+	return ids
+}
+
+// Callback for when a message is received on this server while running
+// one of the counter based algorithms, Lai-Yang or Mattern (mattern.go)
+func (server *Server) handleCountingPacket(src string, message interface{}) {
+	switch message := message.(type) {
+	case TokenMessage:
+		// A red message of an unknown snapshot must not be handled before
+		// the local state is recorded, otherwise its tokens are counted twice
+		if server.sim.algorithm == Mattern {
+			server.passCuts(src, message.clock)
+			server.mergeClock(message.clock)
+		} else {
+			for _, snapshotId := range message.recorded {
+				if _, ok := server.GetLocalSnapshot(snapshotId); !ok {
+					server.recordSnapshot(snapshotId, -1, src)
+				}
+			}
+		}
+		server.received[src]++
+		server.snapshots.Range(func(_, value interface{}) bool {
+			local := value.(*LocalSnapshot)
+			if !local.recording[src] || server.isRed(message, local.id) {
+				return true
+			}
+			local.whites[src]++
+			local.messages = append(local.messages,
+				&SnapshotMessage{src, server.Id, TokenMessage{numTokens: message.numTokens}})
+			server.checkLinkComplete(local, src)
+			return true
+		})
+		server.Tokens += message.numTokens
+	case ControlMessage:
+		local, ok := server.GetLocalSnapshot(message.snapshotId)
+		if !ok {
+			local = server.recordSnapshot(message.snapshotId, -1, src)
+		}
+		local.expected[src] = message.numMessages
+		server.checkLinkComplete(local, src)
+	case CutMessage:
+		server.learnCut(src, message.cut)
+	case CutAckMessage:
+		server.handleCutAck(message)
+	case SnapshotReportMessage:
+		server.handleSnapshotReport(message)
+	default:
+		log.Fatal("服务器接受到的 message 类型不明确：message = ", message)
+	}
+}
+
+// Whether the message was sent after its sender recorded the given snapshot
+func (server *Server) isRed(message TokenMessage, snapshotId int) bool {
+	if server.sim.algorithm == Mattern {
+		cut := server.cuts[snapshotId]
+		return message.clock[cut.serverId] >= cut.time
+	}
+	for _, id := range message.recorded {
+		if id == snapshotId {
+			return true
+		}
+	}
+	return false
+}
+
+// Stop recording on the link once every white message sent on it has been received
+func (server *Server) checkLinkComplete(local *LocalSnapshot, src string) {
+	expected, ok := local.expected[src]
+	if !ok || !local.recording[src] || local.whites[src] < expected {
+		return
+	}
+	local.markers[src] = true
+	local.recording[src] = false
+	server.checkSnapshotComplete(local)
+}
@@ -0,0 +1,124 @@
+package lamport
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+)
+
+// A unidirectional（单向） communication通信 channel between two servers
+// Each link contains an event queue（事件队列） (as opposed to（而不是） a packet queue)
+type Link struct {
+	src    string
+	dest   string
+	events *Queue
+	order  LinkOrder
+	delay  DelayModel // nil = the simulator's delay model
+	// Maximum number of messages in flight, 0 = unbounded, see backpressure.go
+	capacity int
+	// Messages waiting at the sender for the link to have room
+	backlog *Queue
+	// Probabilities that a message is lost or duplicated, see faults.go
+	loss float64
+	dup  float64
+	// Sequence numbers and acknowledgements, see reliable.go
+	transport *reliableLink
+}
+
+// The order in which a link hands its queued messages to the destination.
+// Chandy-lamport assumes FIFO links; the other orders let a message sent
+// later overtake an earlier one.
+// 信道的投递顺序，只有 FifoOrder 满足 chandy-lamport 的前提
+type LinkOrder int
+
+const (
+	// Only the oldest message may be delivered, once its receive time has come
+	FifoOrder LinkOrder = iota
+	// Any message whose receive time has come may be delivered, chosen at random
+	RandomOrder
+	// The message with the earliest receive time is delivered first,
+	// the oldest one among messages with the same receive time
+	EarliestOrder
+)
+
+func (order LinkOrder) String() string {
+	switch order {
+	case FifoOrder:
+		return "fifo"
+	case RandomOrder:
+		return "random"
+	case EarliestOrder:
+		return "earliest"
+	}
+	return fmt.Sprintf("LinkOrder(%d)", int(order))
+}
+
+// Parse a link order from its name in a ".top" file, e.g. "order=random"
+func parseLinkOrder(name string) (LinkOrder, error) {
+	for _, order := range []LinkOrder{FifoOrder, RandomOrder, EarliestOrder} {
+		if order.String() == name {
+			return order, nil
+		}
+	}
+	return FifoOrder, fmt.Errorf("unknown link order %q", name)
+}
+
+// Remove and return the next message that can be delivered at the given time, if any.
+// A random order draws from the given generator.
+func (link *Link) popReady(time int, rng *rand.Rand) (SendMessageEvent, bool) {
+	if link.events.Empty() {
+		return SendMessageEvent{}, false
+	}
+	switch link.order {
+	case FifoOrder:
+		e := link.events.Peek().(SendMessageEvent)
+		if e.receiveTime <= time {
+			link.events.Pop()
+			return e, true
+		}
+	case RandomOrder:
+		ready := make([]int, 0)
+		for i, item := range link.events.Items() {
+			if item.(SendMessageEvent).receiveTime <= time {
+				ready = append(ready, i)
+			}
+		}
+		if len(ready) > 0 {
+			return link.events.RemoveAt(ready[rng.Intn(len(ready))]).(SendMessageEvent), true
+		}
+	case EarliestOrder:
+		earliest := -1
+		var next SendMessageEvent
+		for i, item := range link.events.Items() {
+			e := item.(SendMessageEvent)
+			if earliest < 0 || e.receiveTime < next.receiveTime {
+				earliest = i
+				next = e
+			}
+		}
+		if next.receiveTime <= time {
+			link.events.RemoveAt(earliest)
+			return next, true
+		}
+	default:
+		log.Fatal("Unknown link order: ", link.order)
+	}
+	return SendMessageEvent{}, false
+}
+
+// Return the earliest time step at which a queued message may be delivered, if any
+func (link *Link) nextReceiveTime() (int, bool) {
+	if link.events.Empty() {
+		return 0, false
+	}
+	if link.order == FifoOrder {
+		return link.events.Peek().(SendMessageEvent).receiveTime, true
+	}
+	earliest := -1
+	for _, item := range link.events.Items() {
+		if e := item.(SendMessageEvent); earliest < 0 || e.receiveTime < earliest {
+			earliest = e.receiveTime
+		}
+	}
+	return earliest, true
+}
@@ -0,0 +1,205 @@
+package lamport
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// ================
+//  Live runtime
+// ================
+
+// Instead of the discrete time steps of the simulator, the live runtime runs every
+// server in its own goroutine, with a goroutine per link forwarding the messages to the
+// destination after a wall-clock delay. There is no global tick: the servers handle
+// messages as they arrive, concurrently, with the same protocol code as the simulator.
+// Snapshots are started and collected through the same API, e.g.
+//
+//	sim.StartLive(time.Millisecond)
+//	sim.InjectEvent(SnapshotEvent{"N1"})
+//	snap := sim.CollectSnapshot(0)
+//	sim.StopLive()
+//
+// Delays are drawn from the delay models, one unit being the given duration. Links are
+// FIFO, and the delivery policy does not apply. The features tied to the time steps of
+// the simulator (bounded links, faults, reliable delivery, crashes, partitions, topology
+// changes and merged snapshots) are not available.
+//
+// 实时模式：每个服务器一个 goroutine，信道用 Go channel 实现，没有全局时钟
+
+type LiveRuntime struct {
+	sim  *Simulator
+	unit time.Duration
+	// key = server ID, the functions run by the goroutine of the server, in order
+	inboxes map[string]chan func()
+	// The messages sent on each link
+	links map[*Link]chan liveMessage
+	// Guards the random generator of the simulator
+	rngLock sync.Mutex
+	// Messages and commands not handled yet
+	pending     int
+	pendingLock sync.Mutex
+	idle        *sync.Cond
+	stop        chan bool
+	done        sync.WaitGroup
+}
+
+// A message on its way to the destination
+type liveMessage struct {
+	message   interface{}
+	deliverAt time.Time
+}
+
+// Start running every server in its own goroutine, one unit of delay lasting the given duration.
+// Must be called once the topology has been read.
+func (sim *Simulator) StartLive(unit time.Duration) {
+	if sim.live != nil {
+		log.Fatal("The live runtime is already running")
+	}
+	if sim.mergeSnapshots || sim.reliable {
+		log.Fatal("Merged snapshots and reliable delivery are not available in the live runtime")
+	}
+	live := &LiveRuntime{
+		sim:     sim,
+		unit:    unit,
+		inboxes: make(map[string]chan func()),
+		links:   make(map[*Link]chan liveMessage),
+		stop:    make(chan bool)}
+	live.idle = sync.NewCond(&live.pendingLock)
+	for _, server := range sim.sortedServers() {
+		live.inboxes[server.Id] = make(chan func())
+	}
+	if sim.partition != nil {
+		log.Fatal("Partitions are not available in the live runtime")
+	}
+	for _, server := range sim.sortedServers() {
+		if server.crashed {
+			log.Fatal("Crashes are not available in the live runtime")
+		}
+		for _, dest := range server.getSortedLinks() {
+			link := server.outboundLinks[dest]
+			if link.capacity > 0 || link.loss > 0 || link.dup > 0 {
+				log.Fatalf("Bounded and faulty links are not available in the live runtime, see %v -> %v\n",
+					link.src, link.dest)
+			}
+			in := make(chan liveMessage)
+			live.links[link] = in
+			live.done.Add(1)
+			go live.runLink(link, in)
+		}
+		live.done.Add(1)
+		go live.runServer(live.inboxes[server.Id])
+	}
+	sim.live = live
+	sim.transport = live
+}
+
+// Stop the goroutines of the live runtime, once every message has been handled
+func (sim *Simulator) StopLive() {
+	sim.live.waitIdle()
+	close(sim.live.stop)
+	sim.live.done.Wait()
+	sim.live = nil
+	sim.transport = queueTransport{sim}
+}
+
+// Run the function on the goroutine of the server, or right away in the simulator
+func (sim *Simulator) runOn(server *Server, f func()) {
+	if sim.live == nil {
+		f()
+		return
+	}
+	sim.live.post(server.Id, f)
+}
+
+func (sim *Simulator) requireSimulated(what string) {
+	if sim.live != nil {
+		log.Fatalf("%v is not available in the live runtime\n", what)
+	}
+}
+
+func (live *LiveRuntime) post(serverId string, f func()) {
+	live.addPending(1)
+	live.inboxes[serverId] <- f
+}
+
+func (live *LiveRuntime) addPending(delta int) {
+	live.pendingLock.Lock()
+	live.pending += delta
+	if live.pending == 0 {
+		live.idle.Broadcast()
+	}
+	live.pendingLock.Unlock()
+}
+
+// Wait until every message sent so far has been handled
+func (live *LiveRuntime) waitIdle() {
+	live.pendingLock.Lock()
+	for live.pending > 0 {
+		live.idle.Wait()
+	}
+	live.pendingLock.Unlock()
+}
+
+// The goroutine of a server: handle the messages and commands one at a time
+func (live *LiveRuntime) runServer(inbox chan func()) {
+	defer live.done.Done()
+	for {
+		select {
+		case f := <-inbox:
+			f()
+			live.addPending(-1)
+		case <-live.stop:
+			return
+		}
+	}
+}
+
+// Put a message on the link, to be delivered after a random delay
+func (live *LiveRuntime) Send(link *Link, message interface{}) {
+	delay := live.sim.delay
+	if link.delay != nil {
+		delay = link.delay
+	}
+	live.rngLock.Lock()
+	units := delay.Delay(live.sim.rng)
+	live.rngLock.Unlock()
+	live.addPending(1)
+	live.links[link] <- liveMessage{message, time.Now().Add(time.Duration(units) * live.unit)}
+}
+
+// The goroutine of a link: hold the messages until their delay has passed and hand
+// them to the destination in the order they were sent. It keeps accepting messages
+// while the destination is busy, so that two servers sending to each other never block.
+func (live *LiveRuntime) runLink(link *Link, in chan liveMessage) {
+	defer live.done.Done()
+	queue := make([]liveMessage, 0)
+	inbox := live.inboxes[link.dest]
+	for {
+		var out chan func()
+		var deliver func()
+		var wait <-chan time.Time
+		if len(queue) > 0 {
+			if delay := time.Until(queue[0].deliverAt); delay > 0 {
+				wait = time.After(delay)
+			} else {
+				out = inbox
+				message := queue[0].message
+				deliver = func() {
+					live.sim.deliver(link.src, live.sim.servers[link.dest], message)
+				}
+			}
+		}
+		select {
+		case m := <-in:
+			queue = append(queue, m)
+		case <-wait:
+		case out <- deliver:
+			// Counted as pending since it was sent, until the destination handles it
+			queue = queue[1:]
+		case <-live.stop:
+			return
+		}
+	}
+}
@@ -3,6 +3,8 @@ package lamport
 import (
 	"fmt"
 	"log"
+	"strings"
+	"sync"
 )
 
 // =================================
@@ -10,9 +12,19 @@ import (
 // =================================
 
 type Logger struct {
-	// index = time step
-	// value = events that occurred at that time step
-	events [][]LogEvent
+	// Lines printed before the events, describing how the run can be reproduced
+	header []string
+	// The time steps at which events may have occurred, in order.
+	// Time steps skipped by the simulator have no epoch.
+	epochs []LogEpoch
+	// Guards the epochs, as the servers record events concurrently in the live runtime
+	lock sync.Mutex
+}
+
+// The events that occurred at a time step
+type LogEpoch struct {
+	time   int
+	events []LogEvent
 }
 
 type LogEvent struct { //server.Id, server.Tokens, event
@@ -38,6 +50,16 @@ func (event LogEvent) String() string {
 	case StartSnapshot:
 		prependWithTokens = true
 	case EndSnapshot:
+	case BlockedMessageEvent, DroppedMessageEvent:
+	case LostMessageEvent, DuplicatedMessageEvent, RetransmitEvent, DiscardedDuplicateEvent:
+	case CrashEvent, RecoverEvent, CrashDroppedEvent, SnapshotFailedEvent:
+	case PartitionEvent, HealEvent, PartitionDroppedEvent:
+	case AddServerEvent, RemoveServerEvent, AddLinkEvent, RemoveLinkEvent:
+	case RestoreEvent:
+	case RefundEvent:
+		prependWithTokens = true
+	case FailedSendEvent:
+		prependWithTokens = true
 	default:
 		log.Fatal("Attempted to log unrecognized event: ", event.event)
 	}
@@ -52,32 +74,57 @@ func (event LogEvent) String() string {
 }
 
 func NewLogger() *Logger {
-	return &Logger{make([][]LogEvent, 0)}
+	return &Logger{header: make([]string, 0), epochs: make([]LogEpoch, 0)}
+}
+
+func (log *Logger) AddHeader(line string) {
+	log.header = append(log.header, line)
+}
+
+// Set the header line of the given name, e.g. "Delivery: all-ready"
+func (log *Logger) SetHeader(name string, value string) {
+	line := fmt.Sprintf("%v: %v", name, value)
+	for i, other := range log.header {
+		if strings.HasPrefix(other, name+": ") {
+			log.header[i] = line
+			return
+		}
+	}
+	log.AddHeader(line)
 }
 
 func (log *Logger) PrettyPrint() {
-	for epoch, events := range log.events {
-		if len(events) != 0 {
-			fmt.Printf("Time %v:\n", epoch)
+	for _, line := range log.header {
+		fmt.Println(line)
+	}
+	for _, epoch := range log.epochs {
+		if len(epoch.events) != 0 {
+			fmt.Printf("Time %v:\n", epoch.time)
 		}
-		for _, event := range events {
+		for _, event := range epoch.events {
 			fmt.Printf("\t%v\n", event)
 		}
 	}
 }
 
-func (log *Logger) NewEpoch() {
-	log.events = append(log.events, make([]LogEvent, 0))
+// Start recording the events of the given time step, unless already doing so
+func (log *Logger) NewEpoch(time int) {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+	if n := len(log.epochs); n > 0 && log.epochs[n-1].time == time {
+		return
+	}
+	log.epochs = append(log.epochs, LogEpoch{time, make([]LogEvent, 0)})
 	//time step and events
 }
 
 func (logger *Logger) RecordEvent(server *Server, event interface{}) {
 	//参数 例 (server, SentMessageEvent{server.Id, dest, message})
-	// index = time step
-	// value = events that occurred at that time step
-	//events [][]LogEvent
-	mostRecent := len(logger.events) - 1  //logger中的enents事件
-	events := logger.events[mostRecent]
+	// The events of the current time step are recorded in the most recent epoch
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+	mostRecent := len(logger.epochs) - 1  //logger中的enents事件
+	events := logger.epochs[mostRecent].events
 	events = append(events, LogEvent{server.Id, server.Tokens, event})
 	/*
 	LogEvent中的字段
@@ -85,6 +132,16 @@ func (logger *Logger) RecordEvent(server *Server, event interface{}) {
 	serverTokens int 执行事件前的tokens
 	event        interface{}
 	*/
-	logger.events[mostRecent] = events
+	logger.epochs[mostRecent].events = events
 	log.Printf("已经记录下了事件\n , %v \n",events)
 }
+
+// Record an event of the network itself, such as a partition, that happens on no server
+func (logger *Logger) RecordNetworkEvent(event interface{}) {
+	logger.lock.Lock()
+	defer logger.lock.Unlock()
+	mostRecent := len(logger.epochs) - 1
+	logger.epochs[mostRecent].events = append(
+		logger.epochs[mostRecent].events,
+		LogEvent{"", 0, event})
+}
@@ -0,0 +1,135 @@
+package lamport
+
+import "sort"
+
+// ===================================
+//  Mattern's snapshot algorithm
+// ===================================
+
+// Every server keeps a vector clock, which is piggybacked on its token messages.
+// A snapshot is a cut in the future of its initiator, `clock[initiator] = time`,
+// and every server records its local state when its clock passes the cut:
+//
+//  - The initiator picks a time past its clock and floods the cut in a `CutMessage`.
+//    Every server acknowledges the cut once it knows it with a `CutAckMessage`, sent up
+//    the tree formed by the first cut messages, as the reports of in-band termination
+//    (termination.go).
+//  - Once every server knows the cut, the initiator ticks its clock to the cut time and
+//    records its local state. Until then it does not tick its own entry, so that none of
+//    its events passes the cut before every server can tell.
+//  - Every other server records its local state right before its clock passes the cut,
+//    i.e. before it handles a message sent after the initiator recorded: a token message
+//    whose clock has passed the cut (a red message), or a control message.
+//  - The channel state is derived from message counters as in Lai-Yang (laiyang.go),
+//    with the `ControlMessage` a server sends on every outbound link once it has recorded.
+//
+// 基于向量时钟的快照算法：发起者选择一个未来的向量时间，时钟越过它的服务器记录本地状态
+
+// Flood the cut of a snapshot initiated by this server
+func (server *Server) announceCut(snapshotId int) {
+	time := server.clock[server.Id] + 1
+	for pending := range server.cutAcks {
+		if cut := server.cuts[pending]; cut.time >= time {
+			time = cut.time + 1
+		}
+	}
+	cut := VectorCut{snapshotId, server.Id, time}
+	server.cuts[snapshotId] = cut
+	server.cutAcks[snapshotId] = make(map[string][]string)
+	server.SendToNeighbors(CutMessage{cut})
+	server.handleCutAck(CutAckMessage{snapshotId, server.Id, server.getSortedLinks(), nil})
+}
+
+// Learn about a cut from the given server: relay it the first time and acknowledge it
+func (server *Server) learnCut(src string, cut VectorCut) {
+	if _, ok := server.cuts[cut.snapshotId]; ok {
+		return
+	}
+	server.cuts[cut.snapshotId] = cut
+	server.cutParents[cut.snapshotId] = src
+	server.SendToNeighbors(CutMessage{cut})
+	server.handleCutAck(CutAckMessage{cut.snapshotId, server.Id, server.getSortedLinks(), nil})
+}
+
+// Callback for when an ack is received on this server (or produced by it).
+// The initiator collects the ack, every other server passes it on towards the initiator.
+func (server *Server) handleCutAck(ack CutAckMessage) {
+	if cut, ok := server.cuts[ack.snapshotId]; !ok || cut.serverId != server.Id {
+		server.sendUp(server.cutParents[ack.snapshotId], ack.route, func(route []string) interface{} {
+			ack.route = route
+			return ack
+		})
+		return
+	}
+	acks, ok := server.cutAcks[ack.snapshotId]
+	if !ok {
+		// A flooded copy, once the cut is passed
+		return
+	}
+	acks[ack.serverId] = ack.neighbors
+	server.passOwnCuts()
+}
+
+// Pass the cuts of this server that every server knows, in the order of their times
+// as passing a cut passes the earlier ones too
+func (server *Server) passOwnCuts() {
+	for len(server.cutAcks) > 0 {
+		first := -1
+		for snapshotId := range server.cutAcks {
+			if first < 0 || server.cuts[snapshotId].time < server.cuts[first].time {
+				first = snapshotId
+			}
+		}
+		if !heardFromAll(server.Id, server.cutAcks[first]) {
+			return
+		}
+		delete(server.cutAcks, first)
+		// Recording is the event that passes the cut
+		server.clock[server.Id] = server.cuts[first].time
+		server.recordSnapshot(first, server.sim.time, "")
+	}
+}
+
+// Record the local state for the known cuts that the clock of a message from the given
+// server has passed, before the message is handled
+func (server *Server) passCuts(src string, clock map[string]int) {
+	passed := make([]int, 0)
+	for snapshotId := range server.cutParents {
+		if cut := server.cuts[snapshotId]; clock[cut.serverId] >= cut.time {
+			passed = append(passed, snapshotId)
+		}
+	}
+	sort.Ints(passed)
+	for _, snapshotId := range passed {
+		server.recordSnapshot(snapshotId, -1, src)
+	}
+}
+
+// Tick the entry of this server in its clock, unless that passes
+// one of its own cuts that not every server knows yet
+func (server *Server) tick() {
+	for snapshotId := range server.cutAcks {
+		if server.clock[server.Id]+1 >= server.cuts[snapshotId].time {
+			return
+		}
+	}
+	server.clock[server.Id]++
+}
+
+// Merge the clock of a received message into the clock of this server
+func (server *Server) mergeClock(clock map[string]int) {
+	for serverId, time := range clock {
+		if server.clock[serverId] < time {
+			server.clock[serverId] = time
+		}
+	}
+	server.tick()
+}
+
+func copyClock(clock map[string]int) map[string]int {
+	copied := make(map[string]int, len(clock))
+	for serverId, time := range clock {
+		copied[serverId] = time
+	}
+	return copied
+}
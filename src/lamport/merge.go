@@ -0,0 +1,307 @@
+package lamport
+
+import (
+	"log"
+	"sort"
+)
+
+// ==============================================
+//  Merging concurrent snapshots (Spezialetti-Kearns)
+// ==============================================
+
+// Without merging, every initiation floods its own markers even when several servers
+// initiate a snapshot in the same time step. With `sim.SetMergeConcurrentSnapshots(true)`
+// the snapshots initiated in the same time step (the same "epoch", carried by the marker)
+// become one global snapshot:
+//
+//  - A server joins the region of the first snapshot of the epoch that reaches it,
+//    either by initiating it or through its marker, and records its local state once.
+//  - A marker of another snapshot of the same epoch closes the link just like a marker
+//    of the joined snapshot would. The server remembers the snapshot it merged, and tells
+//    the initiator of that region that it belongs to another one with a border report,
+//    sent back to the server the marker came from.
+//  - Once its snapshot has completed locally, a server sends its state up the tree of
+//    its region, the way the reports of in-band termination go up (termination.go).
+//    The initiator has the result of its region when every neighbor of its servers has
+//    reported, either as a server of the region or as a border.
+//  - The initiators then exchange the results of their regions. An initiator sends every
+//    result it holds to each region its markers reached, down its own tree to the server
+//    that sent the marker, over the link to the border server, and up the other tree.
+//    It passes every result it receives on the same way.
+//  - An initiator holds the merged snapshot once it has the result of every region named
+//    in the states it holds. It then emits the `EndSnapshot` event, and the simulator
+//    returns the merged snapshot of the initiators under every merged ID.
+//
+// 把同一时间步发起的多个快照合并成一个全局快照，只需要一轮 marker；
+// 各区域的发起者交换各自区域的局部快照，拼出全局快照
+
+// Return the snapshot this server joined in the given epoch,
+// joining the given snapshot's region if it has not joined one yet ("" = as its initiator)
+func (server *Server) joinEpoch(snapshotId int, epoch int, parent string) *LocalSnapshot {
+	regionId, ok := server.epochs[epoch]
+	if !ok {
+		server.epochs[epoch] = snapshotId
+		return server.recordSnapshot(snapshotId, epoch, parent)
+	}
+	local, _ := server.GetLocalSnapshot(regionId)
+	if regionId == snapshotId {
+		return local
+	}
+	if !containsId(local.merged, snapshotId) {
+		log.Printf("%v 服务器把快照 %v 合并到快照 %v\n", server.Id, snapshotId, regionId)
+		local.merged = append(local.merged, snapshotId)
+	}
+	if parent != "" {
+		local.regions[parent] = snapshotId
+		server.reportBorder(local, snapshotId, parent)
+	}
+	return local
+}
+
+// Return the snapshot this server recorded among the given merged snapshots
+func (server *Server) getMergedSnapshot(snapshotIds []int) (*LocalSnapshot, bool) {
+	for _, snapshotId := range snapshotIds {
+		if local, ok := server.GetLocalSnapshot(snapshotId); ok {
+			return local, true
+		}
+	}
+	return nil, false
+}
+
+func containsId(ids []int, id int) bool {
+	for _, other := range ids {
+		if other == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Report the state of this server to the initiator of its region
+func (server *Server) reportRegionState(local *LocalSnapshot) {
+	state := ServerState{
+		server.Id,
+		local.id,
+		local.parent,
+		server.getSortedLinks(),
+		local.regions,
+		local.tokens,
+		local.messages}
+	server.handleRegionReport(RegionReportMessage{local.id, state, nil})
+}
+
+// Tell the initiator of the given region that this server joined another one,
+// through the server whose marker of that region arrived here
+func (server *Server) reportBorder(local *LocalSnapshot, snapshotId int, src string) {
+	state := ServerState{serverId: server.Id, region: local.id, parent: src}
+	report := RegionReportMessage{snapshotId, state, nil}
+	server.sendUp(src, nil, func(route []string) interface{} {
+		report.route = route
+		return report
+	})
+}
+
+// Callback for when a region report is received on this server (or produced by it).
+// The initiator of the region collects the report, every other server passes it on.
+func (server *Server) handleRegionReport(report RegionReportMessage) {
+	local, ok := server.GetLocalSnapshot(report.snapshotId)
+	if ok && local.initiator {
+		server.collectRegionState(local, report.state)
+		return
+	}
+	server.sendToRegion(report.snapshotId, report.route, func(route []string) interface{} {
+		report.route = route
+		return report
+	})
+}
+
+// Send a message towards the initiator of the given region: up the tree of the region
+// from its servers, flooded from the others, see sendUp
+func (server *Server) sendToRegion(snapshotId int, route []string, withRoute func(route []string) interface{}) {
+	parent := ""
+	if local, ok := server.GetLocalSnapshot(snapshotId); ok {
+		parent = local.parent
+	}
+	server.sendUp(parent, route, withRoute)
+}
+
+// Record a report on the initiator, and send the result of the region
+// to the other regions once every server of the region has reported
+func (server *Server) collectRegionState(local *LocalSnapshot, state ServerState) {
+	if state.region == local.id {
+		local.states[state.serverId] = state
+	} else if !local.isExit(state.serverId, state.parent) {
+		local.exits = append(local.exits, state)
+	}
+	if _, ok := local.results[local.id]; ok || !local.heardFromRegion(server.Id) {
+		return
+	}
+	states := make([]ServerState, 0)
+	for _, serverId := range getSortedKeys(local.states) {
+		states = append(states, local.states[serverId])
+	}
+	local.results[local.id] = states
+	regions := make([]int, 0)
+	for region := range local.results {
+		regions = append(regions, region)
+	}
+	sort.Ints(regions)
+	for _, region := range regions {
+		server.sendRegionResult(local, region)
+	}
+	server.checkMergeTerminated(local)
+}
+
+// Whether the border report of the given server through the given parent was received
+func (local *LocalSnapshot) isExit(serverId string, parent string) bool {
+	for _, exit := range local.exits {
+		if exit.serverId == serverId && (parent == "" || exit.parent == parent) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the initiator has heard from every server of its region: itself,
+// and every neighbor of a server of the region that is not a border
+func (local *LocalSnapshot) heardFromRegion(serverId string) bool {
+	if _, ok := local.states[serverId]; !ok {
+		return false
+	}
+	for _, state := range local.states {
+		for _, neighbor := range state.neighbors {
+			if _, ok := local.states[neighbor]; !ok && !local.isExit(neighbor, "") {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Send the result of a region to every other region the markers of this initiator reached,
+// through the first border report received from each of them
+func (server *Server) sendRegionResult(local *LocalSnapshot, region int) {
+	sent := make(map[int]bool)
+	for _, exit := range local.exits {
+		if exit.region == region || sent[exit.region] {
+			continue
+		}
+		sent[exit.region] = true
+		result := RegionResultMessage{exit.region, region, local.results[region], local.pathTo(exit), nil}
+		server.handleRegionResult(result)
+	}
+}
+
+// The servers from the initiator (excluded) down its tree to the border server
+func (local *LocalSnapshot) pathTo(exit ServerState) []string {
+	path := []string{exit.serverId}
+	for hop := exit.parent; local.states[hop].parent != ""; hop = local.states[hop].parent {
+		path = append([]string{hop}, path...)
+	}
+	return path
+}
+
+// Callback for when a region result is received on this server (or produced by it).
+// The result follows its path, then goes to the initiator of the region it is sent to.
+func (server *Server) handleRegionResult(result RegionResultMessage) {
+	if len(result.path) > 0 {
+		if link, ok := server.outboundLinks[result.path[0]]; ok {
+			next := result
+			next.path = result.path[1:]
+			server.sim.logger.RecordEvent(server, SentMessageEvent{server.Id, link.dest, next})
+			server.send(link, next)
+			return
+		}
+		// The link was removed since the marker went through it, see topology.go
+		result.path = nil
+	}
+	local, ok := server.GetLocalSnapshot(result.snapshotId)
+	if ok && local.initiator {
+		server.collectRegionResult(local, result)
+		return
+	}
+	server.sendToRegion(result.snapshotId, result.route, func(route []string) interface{} {
+		result.route = route
+		return result
+	})
+}
+
+// Record the result of another region on the initiator, pass it on to the other
+// regions once this region has its own result, and check whether the merged snapshot
+// is complete
+func (server *Server) collectRegionResult(local *LocalSnapshot, result RegionResultMessage) {
+	if _, ok := local.results[result.region]; ok {
+		return
+	}
+	local.results[result.region] = result.states
+	if _, ok := local.results[local.id]; ok {
+		server.sendRegionResult(local, result.region)
+	}
+	server.checkMergeTerminated(local)
+}
+
+// Build the merged snapshot once the initiator holds the result of every region
+// named in the states it holds
+func (server *Server) checkMergeTerminated(local *LocalSnapshot) {
+	if _, ok := local.results[local.id]; !ok || local.terminated {
+		return
+	}
+	for _, exit := range local.exits {
+		if _, ok := local.results[exit.region]; !ok {
+			return
+		}
+	}
+	states := make(map[string]ServerState)
+	for _, result := range local.results {
+		for _, state := range result {
+			for _, region := range state.regions {
+				if _, ok := local.results[region]; !ok {
+					return
+				}
+			}
+			states[state.serverId] = state
+		}
+	}
+	snap := SnapshotState{
+		id:       local.id,
+		tokens:   make(map[string]int),
+		messages: make([]*SnapshotMessage, 0)}
+	// Servers are merged in sorted order and each server's messages
+	// stay in arrival order, as in `CollectSnapshot`
+	for _, serverId := range getSortedKeys(states) {
+		snap.tokens[serverId] = states[serverId].tokens
+		snap.messages = append(snap.messages, states[serverId].messages...)
+	}
+	local.global = &snap
+	local.terminated = true
+	server.sim.logger.RecordEvent(server, EndSnapshot{server.Id, local.id})
+	server.sim.NotifySnapshotTerminated(local.id)
+}
+
+// Whether the initiator of every region of the merged snapshots holds the merged snapshot
+func (progress *SnapshotProgress) regionsTerminated() bool {
+	for _, server := range progress.members {
+		if local, ok := server.getMergedSnapshot(progress.ids); ok && local.initiator && !local.terminated {
+			return false
+		}
+	}
+	return true
+}
+
+// Return the merged snapshot held by the initiator of the given snapshot,
+// or by the first initiator if the snapshot was merged on its initiator
+func (progress *SnapshotProgress) mergedSnapshot(snapshotId int) *SnapshotState {
+	var global *SnapshotState
+	for _, server := range progress.members {
+		local, ok := server.getMergedSnapshot(progress.ids)
+		if ok && local.initiator && (global == nil || local.id == snapshotId) {
+			global = local.global
+		}
+	}
+	if global == nil {
+		log.Fatalf("No initiator holds snapshot %v\n", snapshotId)
+	}
+	snap := *global
+	snap.id = snapshotId
+	return &snap
+}
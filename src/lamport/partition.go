@@ -0,0 +1,193 @@
+package lamport
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// ======================
+//  Network partitions
+// ======================
+
+// A partition splits the servers into groups. While it is active, the links between
+// servers of different groups deliver nothing: depending on the simulator's policy the
+// messages on them either stay queued until the partition heals, or are dropped when
+// they would have been delivered. Servers not named in the partition form one more group.
+//
+// Without the reliable delivery layer, a snapshot whose marker (or other message of
+// the snapshot algorithm) is dropped can never complete, so it fails like a snapshot
+// blocked by a crash, see crash.go. So does a snapshot whose control message counted
+// a dropped token message.
+//
+// 网络分区与恢复
+
+type PartitionPolicy int
+
+const (
+	// The messages on the links across the partition wait until it heals
+	QueueDuringPartition PartitionPolicy = iota
+	// The messages on the links across the partition are dropped
+	DropDuringPartition
+)
+
+func (policy PartitionPolicy) String() string {
+	switch policy {
+	case QueueDuringPartition:
+		return "queue"
+	case DropDuringPartition:
+		return "drop"
+	}
+	return fmt.Sprintf("PartitionPolicy(%d)", int(policy))
+}
+
+// Parse a partition policy from its name, e.g. "drop"
+func parsePartitionPolicy(name string) (PartitionPolicy, error) {
+	for _, policy := range []PartitionPolicy{QueueDuringPartition, DropDuringPartition} {
+		if policy.String() == name {
+			return policy, nil
+		}
+	}
+	return QueueDuringPartition, fmt.Errorf("unknown partition policy %q", name)
+}
+
+// An event parsed from the .events files that represents a partition of the network
+type PartitionEvent struct {
+	groups [][]string
+}
+
+func (m PartitionEvent) String() string {
+	groups := make([]string, 0)
+	for _, group := range m.groups {
+		groups = append(groups, strings.Join(group, ","))
+	}
+	return fmt.Sprintf("network partitioned: %v", strings.Join(groups, " | "))
+}
+
+// An event parsed from the .events files that represents the end of a partition
+type HealEvent struct{}
+
+func (m HealEvent) String() string {
+	return "network healed"
+}
+
+// A message dropped because its link crossed the partition
+type PartitionDroppedEvent struct {
+	src     string
+	dest    string
+	message interface{}
+}
+
+func (m PartitionDroppedEvent) String() string {
+	return fmt.Sprintf("%v to %v dropped by the partition", m.message, m.dest)
+}
+
+// Parse the groups of a partition, e.g. "N1,N2 | N3,N4"
+func parsePartition(spec string) ([][]string, error) {
+	groups := make([][]string, 0)
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(spec, "|") {
+		group := make([]string, 0)
+		for _, serverId := range strings.Split(part, ",") {
+			serverId = strings.TrimSpace(serverId)
+			if serverId == "" {
+				return nil, fmt.Errorf("empty server ID in partition %q", spec)
+			}
+			if seen[serverId] {
+				return nil, fmt.Errorf("server %v is in two groups of partition %q", serverId, spec)
+			}
+			seen[serverId] = true
+			group = append(group, serverId)
+		}
+		groups = append(groups, group)
+	}
+	if len(groups) < 2 {
+		return nil, fmt.Errorf("partition %q needs at least two groups", spec)
+	}
+	return groups, nil
+}
+
+// Set what happens to the messages on the links across a partition
+func (sim *Simulator) SetPartitionPolicy(policy PartitionPolicy) {
+	sim.partitionPolicy = policy
+}
+
+// Split the servers into the given groups, replacing the current partition if any
+func (sim *Simulator) Partition(groups [][]string) {
+	sim.requireSimulated("Partition")
+	partition := make(map[string]int)
+	for i, group := range groups {
+		for _, serverId := range group {
+			if _, ok := sim.servers[serverId]; !ok {
+				log.Fatalf("Unknown server %v in partition\n", serverId)
+			}
+			partition[serverId] = i + 1
+		}
+	}
+	sim.logger.RecordNetworkEvent(PartitionEvent{groups})
+	// The servers that are not named are in group 0
+	sim.partition = partition
+	sim.rescheduleAll()
+}
+
+// End the current partition, if any
+func (sim *Simulator) Heal() {
+	sim.requireSimulated("Heal")
+	sim.logger.RecordNetworkEvent(HealEvent{})
+	sim.partition = nil
+	// The messages queued across the partition can be delivered again
+	sim.rescheduleAll()
+}
+
+// Whether the link crosses the current partition
+func (sim *Simulator) crossesPartition(link *Link) bool {
+	return sim.partition != nil && sim.partition[link.src] != sim.partition[link.dest]
+}
+
+// Drop the message whose link crossed the partition
+func (sim *Simulator) dropAtPartition(e SendMessageEvent) {
+	dest := sim.servers[e.dest]
+	sim.countStats(func(stats *MessageStats) { stats.partitionDropped++ })
+	sim.logger.RecordEvent(dest, PartitionDroppedEvent{e.src, e.dest, e.message})
+	if _, ok := e.message.(TokenMessage); ok {
+		sim.uncountDroppedToken(e)
+		return
+	}
+	if sim.reliable {
+		return
+	}
+	// The destination will never get this message of the snapshot algorithm,
+	// so the snapshot cannot complete anymore unless the destination already completed it
+	progress := sim.getSnapshotProgress(snapshotIdOf(e.message))
+	if progress.hasMember(dest.Id) && !dest.completedSnapshot(progress) {
+		sim.failSnapshot(progress, dest)
+	}
+}
+
+// Return the snapshot a message of the snapshot algorithms belongs to
+func snapshotIdOf(message interface{}) int {
+	switch msg := message.(type) {
+	case MarkerMessage:
+		return msg.snapshotId
+	case ControlMessage:
+		return msg.snapshotId
+	case CutMessage:
+		return msg.cut.snapshotId
+	case CutAckMessage:
+		return msg.snapshotId
+	case SnapshotReportMessage:
+		return msg.snapshotId
+	case RegionReportMessage:
+		return msg.snapshotId
+	case RegionResultMessage:
+		return msg.snapshotId
+	}
+	log.Fatal("Not a message of a snapshot algorithm: ", message)
+	return -1
+}
+
+func (sim *Simulator) rescheduleAll() {
+	for _, serverId := range getSortedKeys(sim.servers) {
+		sim.reschedule(sim.servers[serverId])
+	}
+}
@@ -29,3 +29,25 @@ func (q *Queue) Pop() interface{} {
 func (q *Queue) Peek() interface{} {
 	return q.elements.Back().Value
 }
+
+func (q *Queue) Len() int {
+	return q.elements.Len()
+}
+
+// Return the elements from the oldest to the newest
+func (q *Queue) Items() []interface{} {
+	items := make([]interface{}, 0, q.elements.Len())
+	for e := q.elements.Back(); e != nil; e = e.Prev() {
+		items = append(items, e.Value)
+	}
+	return items
+}
+
+// Remove the i-th oldest element, so RemoveAt(0) is the same as Pop()
+func (q *Queue) RemoveAt(i int) interface{} {
+	e := q.elements.Back()
+	for ; i > 0; i-- {
+		e = e.Prev()
+	}
+	return q.elements.Remove(e)
+}
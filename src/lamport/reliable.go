@@ -0,0 +1,198 @@
+package lamport
+
+import (
+	"fmt"
+	"log"
+)
+
+// ===========================
+//  Reliable delivery layer
+// ===========================
+
+// When enabled, the servers number the messages they send on each link, and the
+// destination acknowledges them. Messages that are not acknowledged in time are sent
+// again (go-back-N), and the destination discards the copies it has already seen and
+// holds back the messages that overtook a lost one. The algorithms above this layer
+// see every message exactly once and in the order it was sent, even over faulty links.
+//
+// Acknowledgements travel back on the link itself, so a link does not need a link
+// in the opposite direction. They are subject to the loss of the link as well.
+//
+// Go-back-N sends the unacknowledged packets again all at once, so this layer is not
+// available on bounded links (backpressure.go).
+//
+// 可靠传输层：序号、确认、超时重传和去重，使得在有丢包和重复的信道上仍然满足 FIFO 且恰好一次
+
+// A message numbered by the reliable delivery layer
+type DataPacket struct {
+	seq     int
+	message interface{}
+}
+
+func (p DataPacket) String() string {
+	return fmt.Sprintf("packet(%v, %v)", p.seq, p.message)
+}
+
+// Acknowledges every packet with a sequence number below `next`
+type AckPacket struct {
+	next int
+}
+
+func (p AckPacket) String() string {
+	return fmt.Sprintf("ack(%v)", p.next)
+}
+
+// The state of the reliable delivery layer on a link
+type reliableLink struct {
+	// Sender side
+	nextSeq  int
+	unacked  []DataPacket // oldest first
+	deadline int          // when the unacked packets are sent again
+	acks     *Queue       // of SendMessageEvent carrying an AckPacket
+	// Receiver side
+	expected int                 // the next sequence number to deliver
+	buffered map[int]interface{} // messages that arrived before `expected`
+}
+
+func newReliableLink() *reliableLink {
+	return &reliableLink{0, make([]DataPacket, 0), 0, NewQueue(), 0, make(map[int]interface{})}
+}
+
+// A packet sent again because it was not acknowledged in time
+type RetransmitEvent struct {
+	src    string
+	dest   string
+	packet DataPacket
+}
+
+func (m RetransmitEvent) String() string {
+	return fmt.Sprintf("%v retransmitted %v to %v", m.src, m.packet, m.dest)
+}
+
+// A packet discarded by the destination because it had already been received
+type DiscardedDuplicateEvent struct {
+	src    string
+	dest   string
+	packet DataPacket
+}
+
+func (m DiscardedDuplicateEvent) String() string {
+	return fmt.Sprintf("%v discarded duplicate %v from %v", m.dest, m.packet, m.src)
+}
+
+// Enable the reliable delivery layer. Must be called before any message is sent.
+func (sim *Simulator) SetReliableDelivery(enabled bool) {
+	if enabled && sim.hasBoundedLink() {
+		log.Fatal("Reliable delivery is not available on bounded links")
+	}
+	sim.reliable = enabled
+}
+
+// The number of time steps a packet waits for its acknowledgement on the given link:
+// long enough for the packet and the acknowledgement to take the slowest path
+func (sim *Simulator) retransmitTimeout(link *Link) int {
+	delay := sim.delay
+	if link.delay != nil {
+		delay = link.delay
+	}
+	return 2*delay.MaxDelay() + 1
+}
+
+// Number the message and keep it until it is acknowledged
+func (server *Server) numberPacket(link *Link, message interface{}) DataPacket {
+	transport := link.transport
+	packet := DataPacket{transport.nextSeq, message}
+	transport.nextSeq++
+	if len(transport.unacked) == 0 {
+		transport.deadline = server.sim.time + server.sim.retransmitTimeout(link)
+		server.sim.schedule(server, transport.deadline)
+	}
+	transport.unacked = append(transport.unacked, packet)
+	return packet
+}
+
+// Handle a packet arriving on one of this server's inbound links,
+// passing the messages that are now in order to `HandlePacket`
+func (server *Server) receivePacket(link *Link, packet DataPacket) {
+	sim := server.sim
+	transport := link.transport
+	_, seen := transport.buffered[packet.seq]
+	switch {
+	case packet.seq < transport.expected || seen:
+		sim.countStats(func(stats *MessageStats) { stats.discarded++ })
+		sim.logger.RecordEvent(server, DiscardedDuplicateEvent{link.src, link.dest, packet})
+	case packet.seq == transport.expected:
+		sim.deliver(link.src, server, packet.message)
+		transport.expected++
+		for {
+			message, ok := transport.buffered[transport.expected]
+			if !ok {
+				break
+			}
+			delete(transport.buffered, transport.expected)
+			sim.deliver(link.src, server, message)
+			transport.expected++
+		}
+	default:
+		// A packet sent earlier was lost or is late
+		transport.buffered[packet.seq] = packet.message
+	}
+	// Acknowledge every time, in case the previous acknowledgement was lost
+	ack := SendMessageEvent{link.dest, link.src, AckPacket{transport.expected}, sim.GetReceiveTime(link)}
+	if sim.lose(link, ack) {
+		return
+	}
+	transport.acks.Push(ack)
+	sim.schedule(sim.servers[link.src], ack.receiveTime)
+}
+
+// Handle the acknowledgements that arrived on this server's outbound links
+// and send again the packets whose acknowledgement is overdue
+func (server *Server) handleAcks() {
+	sim := server.sim
+	for _, dest := range server.getSortedLinks() {
+		link := server.outboundLinks[dest]
+		transport := link.transport
+		for i := 0; i < transport.acks.Len(); {
+			e := transport.acks.Items()[i].(SendMessageEvent)
+			if e.receiveTime > sim.time {
+				i++
+				continue
+			}
+			transport.acks.RemoveAt(i)
+			acked := 0
+			for acked < len(transport.unacked) && transport.unacked[acked].seq < e.message.(AckPacket).next {
+				acked++
+			}
+			if acked > 0 {
+				transport.unacked = transport.unacked[acked:]
+				transport.deadline = sim.time + sim.retransmitTimeout(link)
+			}
+		}
+		if len(transport.unacked) == 0 || transport.deadline > sim.time {
+			continue
+		}
+		// Go back N: send again every packet that was not acknowledged
+		for _, packet := range transport.unacked {
+			sim.countStats(func(stats *MessageStats) { stats.retransmitted++ })
+			sim.logger.RecordEvent(server, RetransmitEvent{server.Id, dest, packet})
+			sim.transmit(link, packet)
+		}
+		transport.deadline = sim.time + sim.retransmitTimeout(link)
+	}
+}
+
+// Return the earliest time step at which the reliable delivery layer
+// needs the sender of the link to be visited, if any
+func (transport *reliableLink) nextWakeTime() (int, bool) {
+	next := -1
+	for _, item := range transport.acks.Items() {
+		if e := item.(SendMessageEvent); next < 0 || e.receiveTime < next {
+			next = e.receiveTime
+		}
+	}
+	if len(transport.unacked) > 0 && (next < 0 || transport.deadline < next) {
+		next = transport.deadline
+	}
+	return next, next >= 0
+}
@@ -0,0 +1,102 @@
+package lamport
+
+import (
+	"fmt"
+	"log"
+)
+
+// ==========================
+//  Restoring from a snapshot
+// ==========================
+
+// A snapshot is a consistent global state: the tokens of every server, and the token
+// messages that were in flight on the links. Restoring it puts the simulator back in
+// that state and the run continues from there:
+//
+//  - every server gets the tokens it had in the snapshot
+//  - everything on the links is discarded, and the recorded messages are put back
+//    on their link, in the order they were recorded, with a new receive time. The ones
+//    a bounded link has no room for wait at the sender, see backpressure.go
+//  - the token counters of the links start over, counting the restored messages as
+//    sent, so that the counter based algorithms stay consistent. The restored
+//    messages are white for every snapshot taken after the restore.
+//
+// The snapshots already taken stay as they are and the next ones get new IDs.
+// Crashes and partitions are not part of the state and stay as they are.
+//
+// 从快照恢复：恢复每个服务器的 tokens，并把记录的在途消息按顺序放回对应的信道
+
+// Restore the snapshot of the given ID, once it has completed
+type RestoreEvent struct {
+	snapshotId int
+}
+
+func (m RestoreEvent) String() string {
+	return fmt.Sprintf("restore snapshot %v", m.snapshotId)
+}
+
+// Put the simulator back in the state recorded by the snapshot.
+// The snapshot must cover every server and no snapshot may be in progress.
+func (sim *Simulator) Restore(snap *SnapshotState) {
+	sim.requireSimulated("Restore")
+	if snap.Failed() {
+		log.Fatalf("Cannot restore snapshot %v, it failed\n", snap.id)
+	}
+	if inProgress := sim.snapshotsInProgress(); len(inProgress) > 0 {
+		log.Fatalf("Cannot restore snapshot %v during snapshot %v\n", snap.id, inProgress[0].ids[0])
+	}
+	if len(snap.tokens) != len(sim.servers) {
+		log.Fatalf("Cannot restore snapshot %v of %v servers on %v servers\n",
+			snap.id, len(snap.tokens), len(sim.servers))
+	}
+	for _, server := range sim.sortedServers() {
+		tokens, ok := snap.tokens[server.Id]
+		if !ok {
+			log.Fatalf("Snapshot %v has no state for server %v\n", snap.id, server.Id)
+		}
+		server.Tokens = tokens
+		server.wake = -1
+		for _, dest := range server.getSortedLinks() {
+			link := server.outboundLinks[dest]
+			link.events = NewQueue()
+			link.backlog = NewQueue()
+			link.transport = newReliableLink()
+			server.sent[dest] = 0
+			sim.servers[dest].received[server.Id] = 0
+		}
+	}
+	sim.wakeups = &wakeupQueue{}
+	sim.logger.RecordNetworkEvent(RestoreEvent{snap.id})
+	for _, msg := range snap.messages {
+		link := sim.getLink(msg.src, msg.dest)
+		src := sim.servers[msg.src]
+		message := msg.message
+		if token, ok := message.(TokenMessage); ok {
+			src.sent[msg.dest]++
+			message = TokenMessage{numTokens: token.numTokens}
+		}
+		if sim.reliable {
+			message = src.numberPacket(link, message)
+		}
+		if link.full() {
+			sim.countStats(func(stats *MessageStats) { stats.blocked++ })
+			sim.logger.RecordEvent(src, BlockedMessageEvent{msg.src, msg.dest, message})
+			link.backlog.Push(SendMessageEvent{msg.src, msg.dest, message, -1})
+			continue
+		}
+		e := SendMessageEvent{msg.src, msg.dest, message, sim.GetReceiveTime(link)}
+		link.events.Push(e)
+		sim.schedule(src, e.receiveTime)
+	}
+}
+
+// Run the simulator until the snapshot of the given ID completes, then restore it
+func (sim *Simulator) restoreSnapshot(snapshotId int) {
+	progress := sim.getSnapshotProgress(snapshotId)
+	for progress.finished < 0 && sim.Step() {
+	}
+	if progress.finished < 0 {
+		log.Fatalf("Cannot restore snapshot %v, it never completes\n", snapshotId)
+	}
+	sim.Restore(sim.CollectSnapshot(snapshotId))
+}
@@ -0,0 +1,191 @@
+package lamport
+
+import (
+	"container/heap"
+	"sort"
+	"time"
+)
+
+// ======================
+//  Event-driven scheduler
+// ======================
+
+// Instead of scanning every link of every server at each time step, the simulator
+// keeps a priority queue of the time steps at which servers may have a message
+// ready on one of their outbound links. A time step without any such server is
+// skipped entirely, and only the servers that are due are scanned.
+//
+// The delivery rules are the same as scanning everything: at each time step the due
+// servers are visited in sorted order, and each delivers the messages chosen by the
+// delivery policy, see delivery.go
+//
+// 基于优先队列的调度器，跳过没有消息可以投递的时间步
+
+// The time a server may have a message ready on one of its outbound links
+type wakeup struct {
+	time     int
+	serverId string
+}
+
+// A min-heap of wakeups, ordered by time and then server ID
+type wakeupQueue []wakeup
+
+func (q wakeupQueue) Len() int { return len(q) }
+
+func (q wakeupQueue) Less(i, j int) bool {
+	if q[i].time != q[j].time {
+		return q[i].time < q[j].time
+	}
+	return q[i].serverId < q[j].serverId
+}
+
+func (q wakeupQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *wakeupQueue) Push(x interface{}) { *q = append(*q, x.(wakeup)) }
+
+func (q *wakeupQueue) Pop() interface{} {
+	old := *q
+	w := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return w
+}
+
+// Make sure the server is visited no later than the given time step.
+// Waking up a server too early is harmless, it is simply rescheduled.
+func (sim *Simulator) schedule(server *Server, time int) {
+	if server.wake >= 0 && server.wake <= time {
+		return
+	}
+	server.wake = time
+	heap.Push(sim.wakeups, wakeup{time, server.Id})
+}
+
+// Schedule the server for the earliest time step after the current one
+// at which one of its outbound links may have a message ready
+func (sim *Simulator) reschedule(server *Server) {
+	next := -1
+	for _, link := range server.outboundLinks {
+		if !sim.canDeliver(link) {
+			// Wait for the destination to recover or the partition to heal,
+			// see crash.go and partition.go
+			continue
+		}
+		if time, ok := link.nextReceiveTime(); ok && (next < 0 || time < next) {
+			next = time
+		}
+		if server.crashed || sim.isCutOff(link) {
+			continue
+		}
+		if time, ok := link.transport.nextWakeTime(); ok && (next < 0 || time < next) {
+			next = time
+		}
+	}
+	if next < 0 {
+		return
+	}
+	if next <= sim.time {
+		next = sim.time + 1
+	}
+	sim.schedule(server, next)
+}
+
+// Return the time step of the next wakeup, if any server is scheduled
+func (sim *Simulator) nextWakeup() (int, bool) {
+	for sim.wakeups.Len() > 0 {
+		w := (*sim.wakeups)[0]
+		if server, ok := sim.servers[w.serverId]; ok && server.wake == w.time {
+			if w.time <= sim.time {
+				return sim.time + 1, true
+			}
+			return w.time, true
+		}
+		// Superseded by an earlier wakeup of the same server, or the server was removed
+		heap.Pop(sim.wakeups)
+	}
+	return 0, false
+}
+
+// Deliver the messages of the servers that are due at the current time step
+func (sim *Simulator) deliverDue() {
+	due := make([]string, 0)
+	for sim.wakeups.Len() > 0 && (*sim.wakeups)[0].time <= sim.time {
+		w := heap.Pop(sim.wakeups).(wakeup)
+		server, ok := sim.servers[w.serverId]
+		if !ok || server.wake != w.time {
+			continue
+		}
+		server.wake = -1
+		due = append(due, w.serverId)
+	}
+	// Note: to ensure deterministic ordering of packet delivery across the servers,
+	//确保服务器之间的确定性顺序
+	// we must also iterate through the servers and the links in a deterministic way
+	// 我们还必须以确定的方式遍历服务器和链接
+	sort.Strings(due)
+	received := make(map[string]bool)
+	for _, serverId := range due {
+		server := sim.servers[serverId] //获取对应的服务器节点
+		if sim.reliable && !server.crashed {
+			server.handleAcks()
+		}
+		// By default, deliver at most one packet per server at each time step to
+		// establish total ordering of packet delivery to each server, see delivery.go
+		//在每个时间步骤中，每个服务器最多交付一个包，以确定向每个服务器交付包的总顺序
+		sim.deliverFrom(server, received)
+		sim.reschedule(server)
+	}
+}
+
+// Hand a message to its destination
+func (sim *Simulator) deliver(src string, dest *Server, message interface{}) {
+	sim.logger.RecordEvent(dest, ReceivedMessageEvent{src, dest.Id, message})
+	dest.HandlePacket(src, message) //接收服务器.HandlePacket(源服务器，传输的信息)
+}
+
+// Advance the simulator time by the given number of steps,
+// skipping the steps at which no message can be delivered
+func (sim *Simulator) TickN(numTicks int) {
+	if sim.live != nil {
+		// There are no time steps in the live runtime, see live.go
+		time.Sleep(time.Duration(numTicks) * sim.live.unit)
+		return
+	}
+	target := sim.time + numTicks
+	for {
+		next, ok := sim.nextWakeup()
+		if !ok || next > target {
+			break
+		}
+		sim.time = next
+		sim.logger.NewEpoch(sim.time)
+		sim.deliverDue()
+	}
+	sim.time = target
+	sim.logger.NewEpoch(sim.time)
+}
+
+// Jump to the next time step at which a message may be delivered and deliver it.
+// Return false if there are no messages left on any link.
+// In the live runtime, wait until every message has been handled and return false.
+func (sim *Simulator) Step() bool {
+	if sim.live != nil {
+		sim.live.waitIdle()
+		return false
+	}
+	next, ok := sim.nextWakeup()
+	if !ok {
+		return false
+	}
+	sim.time = next
+	sim.logger.NewEpoch(sim.time)
+	sim.deliverDue()
+	return true
+}
+
+// Return the keys of the outbound links in sorted order, without sorting them every time
+func (server *Server) getSortedLinks() []string {
+	if server.sortedLinks == nil {
+		server.sortedLinks = getSortedKeys(server.outboundLinks)
+	}
+	return server.sortedLinks
+}
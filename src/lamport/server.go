@@ -2,7 +2,6 @@ package lamport
 
 import (
 	"log"
-	"strings"
 )
 
 // The main participant（参与者） of the distributed snapshot protocol（协议）.
@@ -17,22 +16,72 @@ type Server struct {
 	sim           *Simulator
 	outboundLinks map[string]*Link // key = link.dest 输出信道
 	inboundLinks  map[string]*Link // key = link.src 输入信道
-	// TODO: ADD MORE FIELDS HERE
-	localtokens int
-	snapshotstate string //start notstart complete 三种状态
-	snapshot SnapshotState
+	// key = snapshot ID, value = *LocalSnapshot
+	// 每一个快照都有自己独立的进度，这样并发的快照之间不会互相覆盖
+	snapshots *SyncMap
+	// Snapshots this server has recorded its local state for, in recording order
+	recorded []int
+	// Number of token messages sent (key = link.dest) and received (key = link.src) on each link
+	sent     map[string]int
+	received map[string]int
+	// Mattern only: the vector clock of this server and the cuts it knows, see mattern.go
+	clock map[string]int // key = server ID
+	cuts  map[int]VectorCut
+	// Mattern only: the server each cut was first heard from, until the local state is recorded
+	cutParents map[int]string
+	// Mattern only, on the initiator: the acks of its cuts not every server knows yet,
+	// key = reporting server, value = its outbound neighbors
+	cutAcks map[int]map[string][]string
+	// Used when merging concurrent snapshots,
+	// key = epoch, value = ID of the snapshot this server joined in that epoch
+	epochs map[int]int
+	// The last snapshot completed on this server, -1 if none
+	lastComplete int
+	// Used by the scheduler (scheduler.go): the time step this server is
+	// scheduled to deliver at (-1 if none), and the sorted keys of outboundLinks
+	wake        int
+	sortedLinks []string
+	// Whether this server is crashed, see crash.go
+	crashed bool
+	// The destination of the link this server delivered from last, see delivery.go
+	lastDelivered string
 }
 
-type SnapState struct {
-	tokens int
-	State string
-}
-// A unidirectional（单向） communication通信 channel between two servers
-// Each link contains an event queue（事件队列） (as opposed to（而不是） a packet queue)
-type Link struct {
-	src    string
-	dest   string
-	events *Queue
+// The progress of a single snapshot on a single server.
+// 单个服务器上某一个快照的进度
+type LocalSnapshot struct {
+	id        int
+	epoch     int                // the time step the snapshot was initiated at, -1 if unknown
+	tokens    int                // tokens on the server when the local state was recorded
+	markers   map[string]bool    // key = link.src, inbound links that already delivered the marker
+	recording map[string]bool    // key = link.src, inbound links whose channel state is being recorded
+	messages  []*SnapshotMessage // messages recorded on the inbound links, in arrival order
+	complete  bool               // whether every inbound link has delivered the marker
+	initiator bool               // whether this server initiated the snapshot
+	// The server whose message made this server record its local state ("" on the initiator),
+	// the parent in the spanning tree the in-band termination reports go up
+	parent string
+	// Used by the initiator for in-band termination detection
+	reports    map[string][]string // key = reporting server, value = its outbound neighbors
+	terminated bool
+	// Used by the counter based algorithms, key = link.src
+	whites   map[string]int // white messages received on the link, before and after recording
+	expected map[string]int // white messages sent on the link, known once its control message arrives
+	// Concurrent snapshots merged into this one on this server, and the inbound
+	// neighbors that joined another region, value = that region, see merge.go
+	merged  []int
+	regions map[string]int
+	// Used by the initiator when merging: the states of the servers of its region,
+	// the servers of other regions its markers reached, the states of every region
+	// known so far and, once it has them all, the merged snapshot
+	states  map[string]ServerState // key = server ID
+	exits   []ServerState
+	results map[int][]ServerState // key = region
+	global  *SnapshotState
+	// Used by incremental snapshots: the last snapshot completed on this server when
+	// the local state was recorded (-1 if none), and whether the local state is the same
+	base      int
+	unchanged bool
 }
 
 func NewServer(id string, tokens int, sim *Simulator) *Server {
@@ -42,9 +91,53 @@ func NewServer(id string, tokens int, sim *Simulator) *Server {
 		sim,
 		make(map[string]*Link),
 		make(map[string]*Link),
-		0,
-		"notstart",
-		SnapshotState{sim.nextSnapshotId,make(map[string]int),make([]*SnapshotMessage,0)}}
+		NewSyncMap(),
+		make([]int, 0),
+		make(map[string]int),
+		make(map[string]int),
+		make(map[string]int),
+		make(map[int]VectorCut),
+		make(map[int]string),
+		make(map[int]map[string][]string),
+		make(map[int]int),
+		-1,
+		-1,
+		nil,
+		false,
+		""}
+}
+
+// Return the progress of the given snapshot on this server, if the server has started it
+func (server *Server) GetLocalSnapshot(snapshotId int) (*LocalSnapshot, bool) {
+	local, ok := server.snapshots.Load(snapshotId)
+	if !ok {
+		return nil, false
+	}
+	return local.(*LocalSnapshot), true
+}
+
+// Notify the simulator once every inbound link has delivered the marker of this snapshot.
+// 所有的输入信道都收到了marker，这个服务器上的快照就完成了
+func (server *Server) checkSnapshotComplete(local *LocalSnapshot) {
+	if local.complete {
+		return
+	}
+	// Wait on the inbound links in place when the local state was recorded,
+	// and the ones added between members since, see topology.go
+	for src := range local.recording {
+		if !local.markers[src] {
+			return
+		}
+	}
+	local.complete = true
+	server.lastComplete = local.id
+	if server.sim.mergeSnapshots {
+		server.reportRegionState(local)
+	} else if server.sim.inBandTermination {
+		server.reportSnapshotComplete(local)
+	} else {
+		server.sim.NotifySnapshotComplete(server.Id, local.id)
+	}
 }
 
 // Add a unidirectional（单向） link to the destination（目的地）server
@@ -52,29 +145,37 @@ func (server *Server) AddOutboundLink(dest *Server) {
 	if server == dest {
 		return
 	}
-	l := Link{server.Id, dest.Id, NewQueue()}
+	l := Link{
+		src:       server.Id,
+		dest:      dest.Id,
+		events:    NewQueue(),
+		order:     FifoOrder,
+		backlog:   NewQueue(),
+		transport: newReliableLink()}
 	server.outboundLinks[dest.Id] = &l
+	server.sortedLinks = nil
 	dest.inboundLinks[server.Id] = &l
 }
 
 // Send a message on all of the server's outbound links
 // 向所有相邻的外向信道发送信息
 func (server *Server) SendToNeighbors(message interface{}) {
-	for _, serverId := range getSortedKeys(server.outboundLinks) {
+	for _, serverId := range server.getSortedLinks() {
 		link := server.outboundLinks[serverId]
 		server.sim.logger.RecordEvent(
 			server,
 			SentMessageEvent{server.Id, link.dest, message})
-		link.events.Push(SendMessageEvent{
-			server.Id,
-			link.dest,
-			message,
-			server.sim.GetReceiveTime()})
+		server.send(link, message)
 	}
 }
 
 // 把指定数量的tokens发送到指定的服务器节点
 func (server *Server) SendTokens(numTokens int, dest string) {
+	if server.crashed {
+		server.sim.countStats(func(stats *MessageStats) { stats.failed++ })
+		server.sim.logger.RecordEvent(server, FailedSendEvent{server.Id, dest, numTokens, "crashed"})
+		return
+	}
 	if server.Tokens < numTokens {
 		log.Fatalf(
 			"{Server %v} a想要发送 %v tokens 给 {sever %v}，但是他只有 %v 个节点\n",
@@ -83,73 +184,104 @@ func (server *Server) SendTokens(numTokens int, dest string) {
 	log.Printf("{Server %v} a想要发送 %v tokens 给 {sever %v}，{%v节点} 有 %v 个tokens\n",
 		server.Id, numTokens, dest,server.Id,server.Tokens)
 
-	message := TokenMessage{numTokens}
-	server.sim.logger.RecordEvent(server, SentMessageEvent{server.Id, dest, message})
-	// Update local state before sending the tokens
-	server.Tokens -= numTokens // 减去源服务器要发送的 numtokens
 	link, ok := server.outboundLinks[dest] //获得跟dest服务器连接的外向信道
 	if !ok {
 		log.Fatalf("未知的 dest ID %v from 源 server %v\n", dest, server.Id)
 	}
-	link.events.Push(
-		SendMessageEvent{
-		server.Id,
-		dest,
-		message,
-		server.sim.GetReceiveTime()})
+	if link.full() && server.sim.fullLinkPolicy == FailWhenFull {
+		server.sim.countStats(func(stats *MessageStats) { stats.failed++ })
+		server.sim.logger.RecordEvent(server, FailedSendEvent{server.Id, dest, numTokens, "link full"})
+		return
+	}
+
+	message := TokenMessage{numTokens: numTokens}
+	switch server.sim.algorithm {
+	case LaiYang:
+		// Color the message with the snapshots recorded so far
+		message.recorded = server.recordedInProgress()
+	case Mattern:
+		server.tick()
+		message.clock = copyClock(server.clock)
+	}
+	server.sim.logger.RecordEvent(server, SentMessageEvent{server.Id, dest, message})
+	// Update local state before sending the tokens
+	server.Tokens -= numTokens // 减去源服务器要发送的 numtokens
+	server.send(link, message)
+}
+
+// Queue a message on the given outbound link.
+// The caller is expected to have recorded the `SentMessageEvent`.
+// If the link is full, token messages are blocked or dropped depending on the
+// simulator's policy and the other messages are always blocked, see backpressure.go
+func (server *Server) send(link *Link, message interface{}) {
+	_, isToken := message.(TokenMessage)
+	if isToken && link.full() && server.sim.fullLinkPolicy == DropWhenFull {
+		server.sim.countStats(func(stats *MessageStats) { stats.dropped++ })
+		server.sim.logger.RecordEvent(server, DroppedMessageEvent{server.Id, link.dest, message})
+		return
+	}
+	if token, ok := message.(TokenMessage); ok {
+		server.sent[link.dest]++
+		server.sim.countStats(func(stats *MessageStats) {
+			stats.tokenMessages++
+			stats.piggybacked += len(token.recorded) + len(token.clock)
+		})
+	} else {
+		server.sim.countStats(func(stats *MessageStats) { stats.controlMessages++ })
+	}
+	if server.sim.reliable {
+		message = server.numberPacket(link, message)
+	}
+	if link.full() {
+		server.sim.countStats(func(stats *MessageStats) { stats.blocked++ })
+		server.sim.logger.RecordEvent(server, BlockedMessageEvent{server.Id, link.dest, message})
+		// The receive time is set once the message enters the link
+		link.backlog.Push(SendMessageEvent{server.Id, link.dest, message, -1})
+		return
+	}
+	server.sim.transmit(link, message)
 }
 
 // Callback（回收信号） for when a message is received on this server.
 // When the snapshot algorithm completes on this server,
 // this function should notify（通知） the simulator by calling `sim.NotifySnapshotComplete`
 func (server *Server) HandlePacket(src string, message interface{}) { //接收服务器 .HandlePacket(源服务器，传输的信息)
-	//TODO:IMPLEMENT ME
+	if server.sim.algorithm != ChandyLamport {
+		server.handleCountingPacket(src, message)
+		return
+	}
 	switch message := message.(type) {
 	case TokenMessage: //普通token消息
-		if strings.EqualFold(server.snapshotstate, "start") {
-			server.snapshot.tokens["in"] += message.numTokens
-		}
-		server.Tokens += message.numTokens
-		log.Printf(" ------------------------------------ %v 服务器收到了tokens的数 %v --------------------------- ",server.Id,message.numTokens)
-	case MarkerMessage:    //marker消息 ，向相邻的信道发送
-		if(strings.EqualFold(server.snapshotstate,"start")){
-			//todo：
-			// 1 .把这个marker接收存起来
-			// 2. 判断这个服务器有几个外向信道，并且是否都从这些信道里收到了marker
-			// 	2.1 如果是本服务器收到了不是所有信道都收到了marker信息
-			// 	2.2 如果服务器的全部外向信道都收到了marker消息，的时候调用 sim.NotifySnapshotComplete 方法通知模拟器该服务器已经完成了快照
-			for _,link := range server.outboundLinks{
-				src := link.src
-				dest := link.dest
-				event := link.events
-
-				if(!event.Empty()){
-					if(len(server.snapshot.messages) == len(server.outboundLinks)){
-						//这种情况说明所有外向信道都收到了marker
-						server.sim.NotifySnapshotComplete(server.Id,server.sim.nextSnapshotId)
-						//todo:快照已经完成通知模拟器此服务器快照完成
-					}else if(len(server.snapshot.messages) < len(server.outboundLinks)){
-						server.snapshot.messages = append(server.snapshot.messages,
-							&SnapshotMessage{
-								src:     src,
-								dest:    dest,
-								message: MarkerMessage{server.sim.nextSnapshotId}})
-					}
-				}else{
-					log.Printf("%v 到 %v 的信道为空 \n",src,dest)
-				}
+		server.received[src]++
+		// The message is part of the channel state of every snapshot
+		// that is still recording on the link it arrived on
+		server.snapshots.Range(func(_, value interface{}) bool {
+			local := value.(*LocalSnapshot)
+			if local.recording[src] {
+				local.messages = append(local.messages,
+					&SnapshotMessage{src, server.Id, TokenMessage{numTokens: message.numTokens}})
 			}
-		}else if(strings.EqualFold(server.snapshotstate,"notstart")){
-			//todo:
-			// 1 .把这个marker接收存起来
-			// 2. 如果快照的状态为 "没开始" 的状态那么就开始快照,对本节点相邻的所有外部信道发送 marker
-			server.StartSnapshot(server.sim.nextSnapshotId)
-		}else if(strings.EqualFold(server.snapshotstate,"complete")){
-
-		}else{
-			log.Fatal("server服务器的状态不能识别")
+			return true
+		})
+		server.Tokens += message.numTokens
+	case MarkerMessage: //marker消息，交给对应 snapshotId 的快照处理
+		local, ok := server.GetLocalSnapshot(message.snapshotId)
+		if server.sim.mergeSnapshots {
+			local = server.joinEpoch(message.snapshotId, message.epoch, src)
+		} else if !ok {
+			// First marker of this snapshot: record the local state and flood the marker
+			local = server.recordSnapshot(message.snapshotId, message.epoch, src)
 		}
-		server.StartSnapshot(server.sim.nextSnapshotId);
+		// The marker closes the channel state of this link 这个信道停止记录
+		local.markers[src] = true
+		local.recording[src] = false
+		server.checkSnapshotComplete(local)
+	case SnapshotReportMessage:
+		server.handleSnapshotReport(message)
+	case RegionReportMessage:
+		server.handleRegionReport(message)
+	case RegionResultMessage:
+		server.handleRegionResult(message)
 	default:
 		log.Fatal("服务器接受到的 message 类型不明确：message = ", message)
 	}
@@ -158,15 +290,64 @@ func (server *Server) HandlePacket(src string, message interface{}) { //接收
 // Start the chandy-lamport snapshot algorithm on this server.
 // This should be called only once per server.
 func (server *Server) StartSnapshot(snapshotId int) {
-	// TODO: IMPLEMENT ME
-	//todo:判断一下server的开始快照的状态
-	if(strings.EqualFold(server.snapshotstate,"start")){
-		log.Printf(" =============================== %v 服务器 已经开始快照了 ========================== ",server.Id)
-	}else {
-		//开始快照
-		server.snapshotstate = "start"
-		server.snapshot.tokens["local"] = server.Tokens //本地快照开始，存储本地的tokens状态
-		server.SendToNeighbors(MarkerMessage{snapshotId}) //向相邻的节点发送 marker
-		log.Printf("%v 服务器开始了快照",server.Id)
+	if _, ok := server.GetLocalSnapshot(snapshotId); ok {
+		log.Printf("%v 服务器已经开始了快照 %v\n", server.Id, snapshotId)
+		return
+	}
+	if server.sim.mergeSnapshots {
+		server.joinEpoch(snapshotId, server.sim.time, "")
+		return
+	}
+	if server.sim.algorithm == Mattern {
+		// The local state is recorded once every server knows the cut
+		server.announceCut(snapshotId)
+		return
+	}
+	server.recordSnapshot(snapshotId, server.sim.time, "")
+}
+
+// Record the local state for the given snapshot and send the marker on all outbound links.
+// The parent is the server whose message triggered the recording, "" on the initiator.
+func (server *Server) recordSnapshot(snapshotId int, epoch int, parent string) *LocalSnapshot {
+	initiator := parent == ""
+	local := LocalSnapshot{
+		id:        snapshotId,
+		epoch:     epoch,
+		tokens:    server.Tokens, //本地快照开始，存储本地的tokens状态
+		markers:   make(map[string]bool),
+		recording: make(map[string]bool),
+		messages:  make([]*SnapshotMessage, 0),
+		initiator: initiator,
+		parent:    parent,
+		reports:   make(map[string][]string),
+		whites:    make(map[string]int),
+		expected:  make(map[string]int),
+		merged:    make([]int, 0),
+		regions:   make(map[string]int),
+		states:    make(map[string]ServerState),
+		results:   make(map[int][]ServerState),
+		base:      server.lastComplete}
+	if base, ok := server.GetLocalSnapshot(local.base); ok {
+		local.unchanged = base.tokens == local.tokens
+	}
+	// Start recording on every inbound link 开始记录所有的输入信道
+	for src := range server.inboundLinks {
+		local.recording[src] = true
+		// Every message received before recording is white
+		local.whites[src] = server.received[src]
+	}
+	server.snapshots.Store(snapshotId, &local)
+	server.recorded = append(server.recorded, snapshotId)
+	switch server.sim.algorithm {
+	case LaiYang:
+		server.sendControlMessages(snapshotId)
+	case Mattern:
+		delete(server.cutParents, snapshotId)
+		server.sendControlMessages(snapshotId)
+	default:
+		server.SendToNeighbors(MarkerMessage{snapshotId, epoch}) //向相邻的节点发送 marker
 	}
+	// A server without inbound links has nothing left to wait for
+	server.checkSnapshotComplete(&local)
+	return &local
 }
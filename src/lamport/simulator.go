@@ -1,12 +1,13 @@
 package lamport
 
 import (
+	"fmt"
 	"log"
 	"math/rand"
-	"strings"
+	"sync"
 )
 
-// Max random delay added to packet delivery 传送包的最大延迟
+// Max random delay added to packet delivery by default 传送包的默认最大延迟
 const maxDelay = 5
 
 // Simulator is the entry point to the distributed snapshot application.
@@ -30,43 +31,198 @@ type Simulator struct {
 	nextSnapshotId int
 	servers        map[string]*Server // key = server ID
 	logger         *Logger  //日志
-	// TODO: 加了一个存储全局快照的map
-	globalsnapshot map[string]SnapshotState
+	// key = snapshot ID, value = *SnapshotProgress
+	snapshots *SyncMap
+	// Whether servers detect snapshot termination themselves, see termination.go
+	inBandTermination bool
+	algorithm         SnapshotAlgorithm
+	stats             MessageStats
+	// Whether snapshots initiated in the same time step are merged, see merge.go
+	mergeSnapshots bool
+	// Whether servers only report the local state that changed, see incremental.go
+	incremental bool
+	// key = snapshot ID, value = *SnapshotDelta collected so far
+	deltas *SyncMap
+	// Delay of the messages on the links that do not have their own model
+	delay DelayModel
+	// Source of all the randomness of this simulator, so a run can be reproduced from its seed
+	rng *rand.Rand
+	// The servers that may have a message to deliver, see scheduler.go
+	wakeups *wakeupQueue
+	// What happens to tokens sent on a full link, see backpressure.go
+	fullLinkPolicy FullLinkPolicy
+	// Whether messages are numbered, acknowledged and retransmitted, see reliable.go
+	reliable bool
+	// What happens to the messages sent to a crashed server, see crash.go
+	crashPolicy CrashPolicy
+	// key = server ID, value = group of the current partition, nil = no partition,
+	// see partition.go
+	partition       map[string]int
+	partitionPolicy PartitionPolicy
+	// Which ready messages are delivered at each time step, see delivery.go
+	deliveryPolicy DeliveryPolicy
+	// Guards the stats and the snapshot progress, updated concurrently in the live runtime
+	lock sync.Mutex
+	// How the messages put on the links reach their destination, see transport.go
+	transport Transport
+	// The goroutines running the servers, nil in the simulator, see live.go
+	live *LiveRuntime
+	// The servers running in other processes, nil unless the simulator runs a node, see tcp.go
+	remote map[string]bool
+	// Where the completed snapshots are saved as they are collected, nil = nowhere, see store.go
+	store *SnapshotStore
 }
-type globalsnapshot struct {
-	server string
-	snapstate string
-	snapmap map[string]int // 分为本地local和in内向信道两种
+
+// Counters used to compare the overhead of the snapshot algorithms
+type MessageStats struct {
+	tokenMessages   int
+	controlMessages int // markers, control, cut, cut ack and report messages
+	piggybacked     int // snapshot IDs and clock entries carried by token messages
+	// Sends that found their link full, see backpressure.go
+	blocked int
+	dropped int
+	failed  int
+	// Faults of the links and how the reliable delivery layer recovered from them,
+	// see faults.go and reliable.go
+	lost          int
+	duplicated    int
+	retransmitted int
+	discarded     int
+	crashDropped  int // messages dropped at a crashed server, see crash.go
+	// messages dropped on the links across a partition, see partition.go
+	partitionDropped int
+}
+
+func (stats MessageStats) String() string {
+	return fmt.Sprintf("%v token messages, %v control messages, %v piggybacked values, "+
+		"%v blocked, %v dropped, %v failed, "+
+		"%v lost, %v duplicated, %v retransmitted, %v discarded, %v dropped at crashed servers, "+
+		"%v dropped by partitions",
+		stats.tokenMessages, stats.controlMessages, stats.piggybacked,
+		stats.blocked, stats.dropped, stats.failed,
+		stats.lost, stats.duplicated, stats.retransmitted, stats.discarded, stats.crashDropped,
+		stats.partitionDropped)
+}
+
+// Which servers have completed a snapshot.
+// `done` is closed once the snapshot has completed on every server.
+// Merged snapshots share the same progress.
+type SnapshotProgress struct {
+	completed map[string]bool // key = server ID
+	done      chan bool
+	epoch     int   // the time step the snapshot was initiated at
+	ids       []int // the IDs of the merged snapshots
+	finished  int   // the time step the snapshot completed or failed at, -1 until then
+	// The servers that had not completed the snapshot when it failed, nil unless it failed
+	missing []string
+	// The servers in place when the snapshot started, sorted by ID, see topology.go
+	members []*Server
 }
-func NewSimulator() *Simulator {
-	return &Simulator{
+
+// Create a simulator whose randomness is fully determined by the given seed
+func NewSimulator(seed int64) *Simulator {
+	sim := NewSimulatorFromSource(rand.NewSource(seed))
+	sim.logger.AddHeader(fmt.Sprintf("Seed: %v", seed))
+	return sim
+}
+
+// Create a simulator that draws its randomness from the given source
+func NewSimulatorFromSource(source rand.Source) *Simulator {
+	sim := &Simulator{
 		0,
 		0,
 		make(map[string]*Server), //使用内建函数创建一个map
 		NewLogger(), //创建一个logger
-		make(map[string]SnapshotState)}
+		NewSyncMap(),
+		false,
+		ChandyLamport,
+		MessageStats{},
+		false,
+		false,
+		NewSyncMap(),
+		NewUniformDelay(1, maxDelay),
+		rand.New(source),
+		&wakeupQueue{},
+		BlockWhenFull,
+		false,
+		BufferWhileCrashed,
+		nil,
+		QueueDuringPartition,
+		FirstReadyLink,
+		sync.Mutex{},
+		nil,
+		nil,
+		nil,
+		nil}
+	sim.transport = queueTransport{sim}
+	sim.logger.SetHeader("Delivery", sim.deliveryPolicy.String())
+	return sim
+}
+
+// Choose the snapshot algorithm run by the servers, chandy-lamport by default.
+// This must be called before any snapshot starts.
+func (sim *Simulator) SetAlgorithm(algorithm SnapshotAlgorithm) {
+	sim.algorithm = algorithm
+}
+
+// Let the servers detect snapshot termination in-band instead of
+// notifying the simulator through `NotifySnapshotComplete`.
+// 开启以后由发起快照的服务器自己判断快照是否结束
+func (sim *Simulator) SetInBandTermination(enabled bool) {
+	sim.inBandTermination = enabled
 }
 
-// Return the receive time of a message after adding a random delay.
+// Return the receive time of a message sent on the given link after adding a random delay.
 //在添加随机延迟后返回消息的接收时间
 // Note:
 //因为我们在每一个时间步骤只发送一个信息给sever，所以我们可能在已经收到时间步之后才收到message
 // since we only deliver one message to a given server at each time step,
 // the message may be received *after* the time step returned in this function.
 
-func (sim *Simulator) GetReceiveTime() int { //返回int值
-	return sim.time + 1 + rand.Intn(5)
+func (sim *Simulator) GetReceiveTime(link *Link) int { //返回int值
+	if link.delay != nil {
+		return sim.time + link.delay.Delay(sim.rng)
+	}
+	return sim.time + sim.delay.Delay(sim.rng)
+}
+
+// Set the delay model of the links that do not have their own
+func (sim *Simulator) SetDelayModel(model DelayModel) {
+	sim.delay = model
+}
+
+// Set the delay model of the link between two servers, overriding the simulator's
+func (sim *Simulator) SetLinkDelay(src string, dest string, model DelayModel) {
+	sim.getLink(src, dest).delay = model
+}
+
+// Return the largest delay a message can currently take on any link
+func (sim *Simulator) MaxDelay() int {
+	max := sim.delay.MaxDelay()
+	for _, server := range sim.servers {
+		for _, link := range server.outboundLinks {
+			if link.delay != nil && link.delay.MaxDelay() > max {
+				max = link.delay.MaxDelay()
+			}
+		}
+	}
+	return max
 }
 
 //使用指定数量的启动令牌将服务器添加到此模拟器
 // Add a server to this simulator with the specified number of starting tokens
 func (sim *Simulator) AddServer(id string, tokens int) { // (sim *Simulator)是给Simulator类型定义了一个方法
+	sim.requireSimulated("AddServer")
+	if _, ok := sim.servers[id]; ok {
+		log.Fatalf("Server %v already exists\n", id)
+	}
 	server := NewServer(id, tokens, sim)
 	sim.servers[id] = server
 }
 
 // Add a unidirectional link（单向链接） between two servers
 func (sim *Simulator) AddForwardLink(src string, dest string) {
+	sim.requireSimulated("AddForwardLink")
 	server1, ok1 := sim.servers[src]
 	server2, ok2 := sim.servers[dest]
 	if !ok1 {
@@ -75,7 +231,72 @@ func (sim *Simulator) AddForwardLink(src string, dest string) {
 	if !ok2 {
 		log.Fatalf("Server %v does not exist\n", dest)
 	}
+	if _, ok := server1.outboundLinks[dest]; ok {
+		log.Fatalf("Link %v -> %v already exists\n", src, dest)
+	}
 	server1.AddOutboundLink(server2)
+	if link, ok := server1.outboundLinks[dest]; ok {
+		// A link added during a snapshot, see topology.go
+		sim.linkAdded(link)
+	}
+}
+
+// Return the servers sorted by ID
+func (sim *Simulator) sortedServers() []*Server {
+	servers := make([]*Server, 0)
+	for _, serverId := range getSortedKeys(sim.servers) {
+		servers = append(servers, sim.servers[serverId])
+	}
+	return servers
+}
+
+// Return the total number of tokens on the servers of the simulator
+func simulatorTokens(sim *Simulator) int {
+	expectedTokens := 0
+	for _, server := range sim.servers {
+		expectedTokens += server.Tokens
+	}
+	return expectedTokens
+}
+
+// Set the order in which the link between two servers delivers its messages
+func (sim *Simulator) SetLinkOrder(src string, dest string, order LinkOrder) {
+	sim.getLink(src, dest).order = order
+}
+
+func (sim *Simulator) getLink(src string, dest string) *Link {
+	server, ok := sim.servers[src]
+	if !ok {
+		log.Fatalf("Server %v does not exist\n", src)
+	}
+	link, ok := server.outboundLinks[dest]
+	if !ok {
+		log.Fatalf("Link from %v to %v does not exist\n", src, dest)
+	}
+	return link
+}
+
+// Merge the chandy-lamport snapshots initiated in the same time step into one, see merge.go.
+// This must be called before any snapshot starts.
+// Merging requires chandy-lamport, which is checked when a snapshot starts, so the
+// options can be set in any order. The initiators detect the termination of merged
+// snapshots themselves, whether in-band termination is enabled or not.
+func (sim *Simulator) SetMergeConcurrentSnapshots(enabled bool) {
+	sim.mergeSnapshots = enabled
+}
+
+// Return the number of messages sent so far by the servers of this simulator
+func (sim *Simulator) Stats() MessageStats {
+	sim.lock.Lock()
+	defer sim.lock.Unlock()
+	return sim.stats
+}
+
+// Update the stats, which the servers may do concurrently in the live runtime
+func (sim *Simulator) countStats(count func(stats *MessageStats)) {
+	sim.lock.Lock()
+	count(&sim.stats)
+	sim.lock.Unlock()
 }
 
 //Run an event in the system
@@ -84,9 +305,33 @@ func (sim *Simulator) InjectEvent(event interface{}) {
 	switch event := event.(type) {
 	case PassTokenEvent: //发送事件
 		src := sim.servers[event.src] //返回服务器节点（*sever）
-		src.SendTokens(event.tokens, event.dest) //把指定数量的tokens发送到dest节点
+		sim.runOn(src, func() {
+			src.SendTokens(event.tokens, event.dest) //把指定数量的tokens发送到dest节点
+		})
 	case SnapshotEvent:  //快照事件
 		sim.StartSnapshot(event.serverId) //SnapshotEvent {serverId} 中的serverid为开始快照的id
+	case CrashEvent:
+		sim.CrashServer(event.serverId)
+	case RecoverEvent:
+		sim.RecoverServer(event.serverId)
+	case PartitionEvent:
+		sim.Partition(event.groups)
+	case HealEvent:
+		sim.Heal()
+	case AddServerEvent:
+		sim.AddServer(event.serverId, event.tokens)
+		sim.logger.RecordEvent(sim.servers[event.serverId], event)
+	case RemoveServerEvent:
+		sim.logger.RecordEvent(sim.servers[event.serverId], event)
+		sim.RemoveServer(event.serverId)
+	case AddLinkEvent:
+		sim.logger.RecordNetworkEvent(event)
+		sim.AddForwardLink(event.src, event.dest)
+	case RemoveLinkEvent:
+		sim.logger.RecordNetworkEvent(event)
+		sim.RemoveLink(event.src, event.dest)
+	case RestoreEvent:
+		sim.restoreSnapshot(event.snapshotId)
 	default:
 		log.Fatal("Error unknown event: ", event)
 	}
@@ -97,42 +342,42 @@ func (sim *Simulator) InjectEvent(event interface{}) {
 // if any.
 func (sim *Simulator) Tick() {
 	sim.time++
-	sim.logger.NewEpoch()
-	// Note: to ensure deterministic ordering of packet delivery across the servers,
-	//确保服务器之间的确定性顺序
-	// we must also iterate through the servers and the links in a deterministic way
-	// 我们还必须以确定的方式遍历服务器和链接
-	for _, serverId := range getSortedKeys(sim.servers) {
-		server := sim.servers[serverId] //获取对应的服务器节点
-		for _, dest := range getSortedKeys(server.outboundLinks) { //获得该服务器的外向信道的目的地
-			link := server.outboundLinks[dest] //获得该服务器到dest的外向信道
-			// Deliver at most one packet per server at each time step to
-			// establish total ordering of packet delivery to each server
-			//在每个时间步骤中，每个服务器最多交付一个包，以确定向每个服务器交付包的总顺序
-			if !link.events.Empty() { //信道里的事件不为空的情况下
-				e := link.events.Peek().(SendMessageEvent) //获取信道里的发送事件
-				if e.receiveTime <= sim.time {
-					link.events.Pop() //信道中的sendmessevent的信息弹出队列
-					sim.logger.RecordEvent(
-						sim.servers[e.dest],
-						ReceivedMessageEvent{e.src, e.dest, e.message})
-					sim.servers[e.dest].HandlePacket(e.src, e.message) //接收服务器.HandlePacket(源服务器，传输的信息)
-					break
-				}
-			}
-		}
-	}
+	sim.logger.NewEpoch(sim.time)
+	// Only the servers that may have a message ready are visited, see scheduler.go
+	sim.deliverDue()
 }
 
 // Start a new snapshot process at the specified（在指定的） server
 //在serverid指定的服务器上开始一个节点
 func (sim *Simulator) StartSnapshot(serverId string) {
+	if sim.mergeSnapshots && sim.algorithm != ChandyLamport {
+		log.Fatal("Merging concurrent snapshots requires chandy-lamport")
+	}
 	snapshotId := sim.nextSnapshotId
 	sim.nextSnapshotId++
-	sim.logger.RecordEvent(sim.servers[serverId], StartSnapshot{serverId, snapshotId})
-	//todo:IMPLEMENT ME
+	progress := &SnapshotProgress{make(map[string]bool), make(chan bool), sim.time, []int{snapshotId}, -1, nil, sim.sortedServers()}
+	if sim.mergeSnapshots && snapshotId > 0 {
+		// Join the progress of the snapshots initiated in the same time step
+		previous := sim.getSnapshotProgress(snapshotId - 1)
+		if previous.epoch == sim.time {
+			progress = previous
+			progress.ids = append(progress.ids, snapshotId)
+		}
+	}
+	sim.snapshots.Store(snapshotId, progress)
 	serversrc := sim.servers[serverId] 	//获取到开始快照的服务器
-	serversrc.StartSnapshot(snapshotId) //开始一个快照
+	sim.runOn(serversrc, func() {
+		sim.logger.RecordEvent(serversrc, StartSnapshot{serverId, snapshotId})
+		if !serversrc.crashed {
+			serversrc.StartSnapshot(snapshotId) //开始一个快照
+		}
+	})
+	// The servers that are down cannot take part, see crash.go
+	for _, server := range progress.members {
+		if server.crashed {
+			sim.failSnapshot(progress, server)
+		}
+	}
 }
 
 // Callback for servers to notify（通知） the simulator that
@@ -140,34 +385,99 @@ func (sim *Simulator) StartSnapshot(serverId string) {
 //通知模拟器id为serverid的服务器已经完成快照了
 func (sim *Simulator) NotifySnapshotComplete(serverId string, snapshotId int) {
 	sim.logger.RecordEvent(sim.servers[serverId], EndSnapshot{serverId, snapshotId})
-	// TODO: 服务器通知模拟器本服务器已经完成了快照
-	sim.globalsnapshot[serverId] = sim.servers[serverId].snapshot
-	sim.servers[serverId].snapshotstate = "complete"
+	progress := sim.getSnapshotProgress(snapshotId)
+	sim.lock.Lock()
+	defer sim.lock.Unlock()
+	if progress.completed[serverId] || !progress.hasMember(serverId) {
+		return
+	}
+	progress.completed[serverId] = true
+	if len(progress.completed) == len(progress.members) && progress.missing == nil {
+		progress.finished = sim.time
+		close(progress.done) //所有服务器都完成了，唤醒 CollectSnapshot
+	}
+}
 
+// Callback for the initiator to notify the simulator that it has
+// detected the termination of the snapshot in-band.
+// Merged snapshots terminate once the initiator of every region has, see merge.go
+func (sim *Simulator) NotifySnapshotTerminated(snapshotId int) {
+	progress := sim.getSnapshotProgress(snapshotId)
+	sim.lock.Lock()
+	defer sim.lock.Unlock()
+	if progress.missing != nil || progress.finished >= 0 {
+		return
+	}
+	if sim.mergeSnapshots && !progress.regionsTerminated() {
+		return
+	}
+	progress.finished = sim.time
+	close(progress.done)
 }
 
+// Return the number of time steps the snapshot took to complete.
+// This function blocks until the snapshot process has completed on all servers.
+func (sim *Simulator) SnapshotDuration(snapshotId int) int {
+	progress := sim.getSnapshotProgress(snapshotId)
+	<-progress.done
+	return progress.finished - progress.epoch
+}
+
+func (sim *Simulator) getSnapshotProgress(snapshotId int) *SnapshotProgress {
+	progress, ok := sim.snapshots.Load(snapshotId)
+	if !ok && sim.remote != nil {
+		// Started by a server in another process
+		return sim.trackRemoteSnapshot(snapshotId)
+	}
+	if !ok {
+		log.Fatalf("Unknown snapshot %v\n", snapshotId)
+	}
+	return progress.(*SnapshotProgress)
+}
 
 // Collect and merge（合并） snapshot state from all the servers.
 // This function blocks(阻碍) until the snapshot process has completed on all servers.
 //收集快照的函数
 func (sim *Simulator) CollectSnapshot(snapshotId int) *SnapshotState {
-	snap := SnapshotState{snapshotId, make(map[string]int), make([]*SnapshotMessage, 0)}
-	// TODO: IMPLEMENT ME
-	bool := false
-	count := 0
-	for _,serverid := range getSortedKeys(sim.servers){
-		if(strings.EqualFold(sim.servers[serverid].snapshotstate,"complete")){
-			count += 1
+	snap := sim.collectSnapshot(snapshotId)
+	if sim.store != nil && !snap.Failed() {
+		if err := sim.store.Save(snap); err != nil {
+			log.Fatalf("Cannot save snapshot %v: %v\n", snapshotId, err)
 		}
 	}
-	if(count == len(sim.servers)){
-		bool = true
+	return snap
+}
+
+func (sim *Simulator) collectSnapshot(snapshotId int) *SnapshotState {
+	progress := sim.getSnapshotProgress(snapshotId)
+	<-progress.done
+	if sim.live != nil {
+		// The servers may still be handling messages of other snapshots
+		sim.live.waitIdle()
+	}
+	if progress.missing != nil {
+		return progress.failedSnapshot(snapshotId)
+	}
+	if sim.mergeSnapshots {
+		// Built by the initiators, see merge.go
+		return progress.mergedSnapshot(snapshotId)
 	}
-	if(bool){
-		for _,serverid := range getSortedKeys(sim.servers){
-			snap.tokens[serverid] = sim.servers[serverid].snapshot.tokens["local"] + sim.servers[serverid].snapshot.tokens["in"]
+	if sim.incremental {
+		return sim.expandSnapshot(sim.CollectSnapshotDelta(snapshotId))
+	}
+	snap := SnapshotState{
+		id:       snapshotId,
+		tokens:   make(map[string]int),
+		messages: make([]*SnapshotMessage, 0)}
+	// Servers are merged in sorted order and each server's messages
+	// stay in arrival order, so the result is deterministic
+	for _, server := range progress.members {
+		local, ok := server.getMergedSnapshot(progress.ids)
+		if !ok {
+			log.Fatalf("Server %v did not record snapshot %v\n", server.Id, snapshotId)
 		}
+		snap.tokens[server.Id] = local.tokens
+		snap.messages = append(snap.messages, local.messages...)
 	}
-
 	return &snap
 }
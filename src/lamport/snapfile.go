@@ -0,0 +1,157 @@
+package lamport
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ==================================
+//  Topology and snapshot files
+// ==================================
+
+// The ".top" format of the topologies and the ".snap" format of the snapshots, read by
+// the tests (test_common.go) and by the cluster (cluster.go), which also writes snapshots
+// in the ".snap" format, as does the snapshot store (store.go)
+//
+// .top 拓扑文件和 .snap 快照文件的读写
+
+// Add the servers and links of a topology in the ".top" format to the simulator
+func parseTopology(text string, sim *Simulator) {
+	var err error
+	lines := strings.FieldsFunc( //FieldsFunc把b按照 \n 分隔开
+		text,
+		func(r rune) bool {
+			return r == '\n'
+		})
+
+	// Must call this before we start logging
+	sim.logger.NewEpoch(sim.time)
+
+	// Parse topology(拓扑) from lines
+	numServersLeft := -1
+	for _, line := range lines {
+		// Ignore 忽视    comments 评论
+		if strings.HasPrefix(line, "#") { //判断这一行是否以prefix开头
+			continue
+		}
+		if numServersLeft < 0 {
+			numServersLeft, err = strconv.Atoi(line) //字符串转换为数字
+			checkError(err)
+			continue
+		}
+		// Otherwise, always expect（期望） 2 tokens, links may have options after them
+		parts := strings.Fields(line) //以空白字符切分这一行的字符串
+		if len(parts) < 2 || (numServersLeft > 0 && len(parts) != 2) {
+			log.Fatal("Expected 2 tokens in line: ", line)
+		}
+		if numServersLeft > 0 { // severid 和token数的读取
+			// This is a server
+			serverId := parts[0]
+			numTokens, err := strconv.Atoi(parts[1])
+			checkError(err)
+			sim.AddServer(serverId, numTokens) //模拟器添加一个服务器
+			numServersLeft--
+		} else { //遍历最后两行
+			// This is a link
+			src := parts[0] //遍历发送
+			dest := parts[1]
+			sim.AddForwardLink(src, dest)
+			readLinkOptions(src, dest, parts[2:], sim)
+		}
+	}
+}
+
+// Apply the "key=value" options that follow a link in a ".top" file
+func readLinkOptions(src string, dest string, options []string, sim *Simulator) {
+	for _, option := range options {
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) != 2 {
+			log.Fatal("Expected key=value link option: ", option)
+		}
+		switch kv[0] {
+		case "order":
+			order, err := parseLinkOrder(kv[1])
+			checkError(err)
+			sim.SetLinkOrder(src, dest, order)
+		case "delay":
+			model, err := parseDelayModel(kv[1])
+			checkError(err)
+			sim.SetLinkDelay(src, dest, model)
+		case "loss", "dup":
+			probability, err := strconv.ParseFloat(kv[1], 64)
+			checkError(err)
+			if kv[0] == "loss" {
+				sim.SetLinkLoss(src, dest, probability)
+			} else {
+				sim.SetLinkDuplication(src, dest, probability)
+			}
+		case "capacity":
+			capacity, err := strconv.Atoi(kv[1])
+			checkError(err)
+			sim.SetLinkCapacity(src, dest, capacity)
+		default:
+			log.Fatal("Unknown link option: ", option)
+		}
+	}
+}
+
+// Parse the state of a snapshot in the ".snap" format
+func parseSnapshot(text string) *SnapshotState {
+	var err error
+	snapshot := SnapshotState{id: 0, tokens: make(map[string]int), messages: make([]*SnapshotMessage, 0)}
+	lines := strings.FieldsFunc(text, func(r rune) bool { return r == '\n' }) //根据空格分隔每一行
+	for _, line := range lines {
+		// Ignore comments
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Fields(line)
+		if len(parts) == 1 {
+			// Snapshot ID
+			snapshot.id, err = strconv.Atoi(line)
+			checkError(err)
+		} else if len(parts) == 2 {
+			// Server and its tokens
+			serverId := parts[0]
+			numTokens, err := strconv.Atoi(parts[1])
+			checkError(err)
+			snapshot.tokens[serverId] = numTokens
+		} else if len(parts) == 3 {
+			// Src, dest and message
+			src := parts[0]
+			dest := parts[1]
+			messageString := parts[2]
+			var message interface{}
+			if strings.Contains(messageString, "token") {
+				pattern := regexp.MustCompile(`[0-9]+`)
+				matches := pattern.FindStringSubmatch(messageString)
+				if len(matches) != 1 {
+					log.Fatal("Unable to parse token message: ", messageString)
+				}
+				numTokens, err := strconv.Atoi(matches[0])
+				checkError(err)
+				message = TokenMessage{numTokens: numTokens}
+			} else {
+				log.Fatal("Unknown message: ", messageString)
+			}
+			snapshot.messages =
+				append(snapshot.messages, &SnapshotMessage{src, dest, message})
+		}
+	}
+	return &snapshot
+}
+
+// Format the state of a snapshot in the ".snap" format read by `parseSnapshot`
+func formatSnapshot(snap *SnapshotState) string {
+	lines := []string{strconv.Itoa(snap.id)}
+	for _, serverId := range getSortedKeys(snap.tokens) {
+		lines = append(lines, fmt.Sprintf("%v %v", serverId, snap.tokens[serverId]))
+	}
+	for _, msg := range snap.messages {
+		lines = append(lines, fmt.Sprintf("%v %v %v", msg.src, msg.dest, msg.message))
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
@@ -1,16 +1,36 @@
 package lamport
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"math/rand"
+	"net"
+	"os"
+	"path"
+	"reflect"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 )
 
+// The seed of every simulator in the tests, the golden files depend on it
+const testSeed = 8053172852482175524
+
 func runTest(t *testing.T, topFile string, eventsFile string, snapFiles []string) {
+	runTestWith(t, func(sim *Simulator) {}, topFile, eventsFile, snapFiles)
+}
+
+// Same as `runTest`, but lets the caller configure the simulator before the topology is read
+func runTestWith(t *testing.T, configure func(sim *Simulator), topFile string, eventsFile string, snapFiles []string) {
+	// Every simulator has its own random generator, so the tests can run in parallel
+	t.Parallel()
 	//startMessage := fmt.Sprintf("{测试用的文件是 《'%v'》, 《'%v'》}", topFile, eventsFile)
 	log.Printf("{测试用的文件是 《'%v'》, 《'%v'》}", topFile, eventsFile)
 	if debug {
@@ -20,8 +40,9 @@ func runTest(t *testing.T, topFile string, eventsFile string, snapFiles []string
 	}
 
 	// Initialize simulator (初始化模拟器)
-	rand.Seed(8053172852482175524) //Seed使用提供的seed值将发生器初始化为确定性状态
-	sim := NewSimulator() //创建一个模拟器,分发的工作都是由模拟器来做的
+	//seed使用提供的seed值将模拟器的随机数发生器初始化为确定性状态
+	sim := NewSimulator(testSeed) //创建一个模拟器,分发的工作都是由模拟器来做的
+	configure(sim)
 	readTopology(topFile, sim) //读取节点的原始数据，并把原始数据放到模拟器中
 	actualSnaps := injectEvents(eventsFile, sim) //读取事件数据
 	if len(actualSnaps) != len(snapFiles) {
@@ -113,6 +134,1301 @@ func Test10NodesDirectedEdges(t *testing.T) {
 			"10nodes9.snap",
 		})
 }
+// Run the events against the topology and only verify that every snapshot is consistent.
+// Used for modes whose extra messages change the timing, so the golden files no longer apply.
+func runConsistencyTest(t *testing.T, configure func(sim *Simulator), topFile string, eventsFile string, numSnaps int) {
+	t.Parallel()
+	sim := NewSimulator(testSeed)
+	configure(sim)
+	readTopology(topFile, sim)
+	actualSnaps := injectEvents(eventsFile, sim)
+	if len(actualSnaps) != numSnaps {
+		t.Fatalf("预期有 %v 个snapshot(s), 得到了got %v\n", numSnaps, len(actualSnaps))
+	}
+	checkTokens(sim, actualSnaps)
+}
+
+func inBandTermination(sim *Simulator) {
+	sim.SetInBandTermination(true)
+}
+
+func Test2NodesInBandTermination(t *testing.T) {
+	runTestWith(t, inBandTermination, "2nodes.top", "2nodes-message.events", []string{"2nodes-message.snap"})
+}
+
+func Test8NodesConcurrentSnapshotsInBandTermination(t *testing.T) {
+	runConsistencyTest(t, inBandTermination, "8nodes.top", "8nodes-concurrent-snapshots.events", 5)
+}
+
+func Test10NodesDirectedEdgesInBandTermination(t *testing.T) {
+	runConsistencyTest(t, inBandTermination, "10nodes.top", "10nodes.events", 10)
+}
+
+// With links back to every parent, each report goes up the tree once, one message per hop
+func TestInBandTerminationConvergecast(t *testing.T) {
+	controlMessages := func(inBand bool) (int, *Simulator) {
+		sim := NewSimulator(testSeed)
+		sim.SetInBandTermination(inBand)
+		readTopology("8nodes.top", sim)
+		sim.InjectEvent(SnapshotEvent{"N1"})
+		for sim.Step() {
+		}
+		sim.CollectSnapshot(0)
+		return sim.Stats().controlMessages, sim
+	}
+	markers, _ := controlMessages(false)
+	total, sim := controlMessages(true)
+	hops := 0
+	for _, server := range sim.sortedServers() {
+		local, _ := server.GetLocalSnapshot(0)
+		for local.parent != "" {
+			hops++
+			local, _ = sim.servers[local.parent].GetLocalSnapshot(0)
+		}
+	}
+	if total-markers != hops {
+		t.Fatalf("Expected %v report messages, got %v\n", hops, total-markers)
+	}
+}
+
+// A message sent later overtakes an earlier one only on a non-FIFO link
+func TestLinkOrder(t *testing.T) {
+	expectedFirst := map[LinkOrder]int{FifoOrder: 1, EarliestOrder: 2}
+	for order, first := range expectedFirst {
+		link := Link{src: "N1", dest: "N2", events: NewQueue(), order: order}
+		link.events.Push(SendMessageEvent{"N1", "N2", TokenMessage{numTokens: 1}, 5})
+		link.events.Push(SendMessageEvent{"N1", "N2", TokenMessage{numTokens: 2}, 2})
+		if _, ok := link.popReady(1, nil); ok {
+			t.Fatalf("%v link delivered a message before its receive time\n", order)
+		}
+		e, ok := link.popReady(5, nil)
+		if !ok {
+			t.Fatalf("%v link did not deliver a ready message\n", order)
+		}
+		if e.message.(TokenMessage).numTokens != first {
+			t.Fatalf("%v link delivered %v first, expected token(%v)\n", order, e.message, first)
+		}
+	}
+}
+
+// Without FIFO links a marker can overtake a token sent before it,
+// so plain chandy-lamport misses the token in some of the snapshots
+func TestChandyLamportBreaksWithoutFifo(t *testing.T) {
+	sim := NewSimulator(testSeed)
+	readTopology("2nodes-reorder.top", sim)
+	snapshots := injectEvents("2nodes-reorder.events", sim)
+	inconsistent := 0
+	for _, snap := range snapshots {
+		if snapshotTokens(snap) != simulatorTokens(sim) {
+			inconsistent++
+		}
+	}
+	if inconsistent == 0 {
+		t.Fatalf("Expected a marker to overtake a token in one of the %v snapshots\n", len(snapshots))
+	}
+}
+
+func laiYang(sim *Simulator) {
+	sim.SetAlgorithm(LaiYang)
+}
+
+// On FIFO links Lai-Yang records the same snapshots as chandy-lamport
+func Test8NodesConcurrentSnapshotsLaiYang(t *testing.T) {
+	runTestWith(
+		t,
+		laiYang,
+		"8nodes.top",
+		"8nodes-concurrent-snapshots.events",
+		[]string{
+			"8nodes-concurrent-snapshots0.snap",
+			"8nodes-concurrent-snapshots1.snap",
+			"8nodes-concurrent-snapshots2.snap",
+			"8nodes-concurrent-snapshots3.snap",
+			"8nodes-concurrent-snapshots4.snap",
+		})
+}
+
+func Test10NodesDirectedEdgesLaiYang(t *testing.T) {
+	runTestWith(
+		t,
+		laiYang,
+		"10nodes.top",
+		"10nodes.events",
+		[]string{
+			"10nodes0.snap",
+			"10nodes1.snap",
+			"10nodes2.snap",
+			"10nodes3.snap",
+			"10nodes4.snap",
+			"10nodes5.snap",
+			"10nodes6.snap",
+			"10nodes7.snap",
+			"10nodes8.snap",
+			"10nodes9.snap",
+		})
+}
+
+// Lai-Yang stays consistent on the links that break chandy-lamport
+func Test2NodesReorderLaiYang(t *testing.T) {
+	runConsistencyTest(t, laiYang, "2nodes-reorder.top", "2nodes-reorder.events", 8)
+}
+
+func Test8NodesReorderConcurrentSnapshotsLaiYang(t *testing.T) {
+	runConsistencyTest(t, laiYang, "8nodes-reorder.top", "8nodes-concurrent-snapshots.events", 5)
+}
+
+func mattern(sim *Simulator) {
+	sim.SetAlgorithm(Mattern)
+}
+
+// The servers record their local state once every server knows the cut,
+// later than with the other algorithms, so Mattern has golden files of its own
+func Test8NodesConcurrentSnapshotsMattern(t *testing.T) {
+	runTestWith(
+		t,
+		mattern,
+		"8nodes.top",
+		"8nodes-concurrent-snapshots.events",
+		[]string{
+			"8nodes-concurrent-snapshots-mattern0.snap",
+			"8nodes-concurrent-snapshots-mattern1.snap",
+			"8nodes-concurrent-snapshots-mattern2.snap",
+			"8nodes-concurrent-snapshots-mattern3.snap",
+			"8nodes-concurrent-snapshots-mattern4.snap",
+		})
+}
+
+func Test10NodesDirectedEdgesMattern(t *testing.T) {
+	runTestWith(
+		t,
+		mattern,
+		"10nodes.top",
+		"10nodes.events",
+		[]string{
+			"10nodes-mattern0.snap",
+			"10nodes-mattern1.snap",
+			"10nodes-mattern2.snap",
+			"10nodes-mattern3.snap",
+			"10nodes-mattern4.snap",
+			"10nodes-mattern5.snap",
+			"10nodes-mattern6.snap",
+			"10nodes-mattern7.snap",
+			"10nodes-mattern8.snap",
+			"10nodes-mattern9.snap",
+		})
+}
+
+// Token messages are in flight on a link when its destination passes the cut
+func Test3NodesMattern(t *testing.T) {
+	runTestWith(t, mattern, "3nodes.top", "3nodes-mattern.events", []string{"3nodes-mattern0.snap"})
+}
+
+func Test3NodesMatternEventsLaiYang(t *testing.T) {
+	runConsistencyTest(t, laiYang, "3nodes.top", "3nodes-mattern.events", 1)
+}
+
+func Test8NodesReorderConcurrentSnapshotsMattern(t *testing.T) {
+	runConsistencyTest(t, mattern, "8nodes-reorder.top", "8nodes-concurrent-snapshots.events", 5)
+}
+
+// Every algorithm sends one control message per link and snapshot, Mattern also floods the
+// cut and acknowledges it. Only the counter based ones piggyback data on the token messages.
+func TestAlgorithmOverhead(t *testing.T) {
+	stats := make(map[SnapshotAlgorithm]MessageStats)
+	for _, algorithm := range []SnapshotAlgorithm{ChandyLamport, LaiYang, Mattern} {
+		sim := NewSimulator(testSeed)
+		sim.SetAlgorithm(algorithm)
+		readTopology("8nodes.top", sim)
+		injectEvents("8nodes-concurrent-snapshots.events", sim)
+		stats[algorithm] = sim.Stats()
+		t.Logf("%v: %v\n", algorithm, sim.Stats())
+	}
+	if stats[ChandyLamport].piggybacked != 0 {
+		t.Fatalf("chandy-lamport piggybacked %v values\n", stats[ChandyLamport].piggybacked)
+	}
+	if stats[LaiYang].controlMessages != stats[ChandyLamport].controlMessages {
+		t.Fatalf("lai-yang sent %v control messages, chandy-lamport sent %v\n",
+			stats[LaiYang].controlMessages, stats[ChandyLamport].controlMessages)
+	}
+	if stats[Mattern].controlMessages <= 2*stats[ChandyLamport].controlMessages {
+		t.Fatalf("mattern sent %v control messages, expected more than twice the %v of chandy-lamport\n",
+			stats[Mattern].controlMessages, stats[ChandyLamport].controlMessages)
+	}
+	for _, algorithm := range []SnapshotAlgorithm{LaiYang, Mattern} {
+		if stats[algorithm].piggybacked == 0 {
+			t.Fatalf("%v did not piggyback anything on the token messages\n", algorithm)
+		}
+	}
+}
+
+// Lai-Yang only colors the token messages with the snapshots still in progress,
+// so the messages do not grow with every snapshot ever taken
+func TestLaiYangColorsInProgressOnly(t *testing.T) {
+	sim := NewSimulator(testSeed)
+	sim.SetAlgorithm(LaiYang)
+	readTopology("3nodes.top", sim)
+	for i := 0; i < 5; i++ {
+		sim.InjectEvent(SnapshotEvent{"N1"})
+		for sim.Step() {
+		}
+		sim.CollectSnapshot(i)
+	}
+	before := sim.Stats().piggybacked
+	sim.InjectEvent(PassTokenEvent{"N1", "N2", 1})
+	if piggybacked := sim.Stats().piggybacked - before; piggybacked != 0 {
+		t.Fatalf("Expected no color once the snapshots completed, got %v\n", piggybacked)
+	}
+	sim.InjectEvent(SnapshotEvent{"N1"})
+	sim.InjectEvent(PassTokenEvent{"N1", "N2", 1})
+	if piggybacked := sim.Stats().piggybacked - before; piggybacked != 1 {
+		t.Fatalf("Expected the color of the snapshot in progress only, got %v\n", piggybacked)
+	}
+}
+
+// Snapshots 3 and 4 are initiated in the same time step, so they are merged
+// into one snapshot that takes fewer messages, including the ones the initiators
+// exchange, than separate snapshots whose termination is detected in-band
+func Test8NodesMergeConcurrentSnapshots(t *testing.T) {
+	plain := NewSimulator(testSeed)
+	plain.SetInBandTermination(true)
+	readTopology("8nodes.top", plain)
+	injectEvents("8nodes-concurrent-snapshots.events", plain)
+
+	sim := NewSimulator(testSeed)
+	sim.SetMergeConcurrentSnapshots(true)
+	readTopology("8nodes.top", sim)
+	snapshots := injectEvents("8nodes-concurrent-snapshots.events", sim)
+	if len(snapshots) != 5 {
+		t.Fatalf("预期有 %v 个snapshot(s), 得到了got %v\n", 5, len(snapshots))
+	}
+	checkTokens(sim, snapshots)
+	sortSnapshots(snapshots)
+	merged := *snapshots[4]
+	merged.id = 3
+	assertEqual(snapshots[3], &merged)
+	// Each initiator built the merged snapshot from the results of both regions
+	for _, serverId := range []string{"N6", "N2"} {
+		local, _ := sim.servers[serverId].getMergedSnapshot([]int{3, 4})
+		if !local.initiator || len(local.results) != 2 || local.global == nil {
+			t.Fatalf("Expected %v to hold the results of both regions, got %v\n", serverId, len(local.results))
+		}
+	}
+	if sim.Stats().controlMessages >= plain.Stats().controlMessages {
+		t.Fatalf("Merged snapshots sent %v control messages, expected fewer than %v\n",
+			sim.Stats().controlMessages, plain.Stats().controlMessages)
+	}
+}
+
+// On a one-way ring every server of a region reaches the initiator of the other
+// region, and the border reports and the results go round the ring back to it
+func Test10NodesMergeConcurrentSnapshotsOnRing(t *testing.T) {
+	sim := NewSimulator(testSeed)
+	sim.SetMergeConcurrentSnapshots(true)
+	readTopology("10nodes.top", sim)
+	snapshots := injectEvents("10nodes-concurrent-snapshots.events", sim)
+	if len(snapshots) != 2 {
+		t.Fatalf("预期有 %v 个snapshot(s), 得到了got %v\n", 2, len(snapshots))
+	}
+	checkTokens(sim, snapshots)
+	sortSnapshots(snapshots)
+	merged := *snapshots[1]
+	merged.id = 0
+	assertEqual(snapshots[0], &merged)
+	for _, serverId := range []string{"N1", "N6"} {
+		local, _ := sim.servers[serverId].getMergedSnapshot([]int{0, 1})
+		if len(local.results) != 2 || len(local.states) != 5 {
+			t.Fatalf("Expected %v to hold 2 regions of 5 servers, got %v regions and %v servers\n",
+				serverId, len(local.results), len(local.states))
+		}
+	}
+}
+
+// The expanded incremental snapshots are the same as the full ones,
+// while the deltas leave out the servers whose state did not change
+func Test10NodesIncrementalSnapshots(t *testing.T) {
+	var sim *Simulator
+	runTestWith(
+		t,
+		func(s *Simulator) {
+			sim = s
+			sim.SetIncrementalSnapshots(true)
+		},
+		"10nodes.top",
+		"10nodes.events",
+		[]string{
+			"10nodes0.snap",
+			"10nodes1.snap",
+			"10nodes2.snap",
+			"10nodes3.snap",
+			"10nodes4.snap",
+			"10nodes5.snap",
+			"10nodes6.snap",
+			"10nodes7.snap",
+			"10nodes8.snap",
+			"10nodes9.snap",
+		})
+	unchanged := 0
+	for id := 0; id < 10; id++ {
+		delta := sim.CollectSnapshotDelta(id)
+		if len(delta.tokens)+len(delta.bases) != len(sim.servers) {
+			t.Fatalf("Snapshot %v: delta covers %v servers, expected %v\n",
+				id, len(delta.tokens)+len(delta.bases), len(sim.servers))
+		}
+		unchanged += len(delta.bases)
+	}
+	if unchanged == 0 {
+		t.Fatalf("Expected some servers to be left out of the deltas\n")
+	}
+}
+
+func TestDelayModels(t *testing.T) {
+	specs := []string{"fixed:3", "uniform:2:4", "exponential:2:10", "bimodal:1:20:0.1", "trace:1,4,2"}
+	for _, spec := range specs {
+		model, err := parseDelayModel(spec)
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		rng := rand.New(rand.NewSource(testSeed))
+		for i := 0; i < 100; i++ {
+			if delay := model.Delay(rng); delay < 1 || delay > model.MaxDelay() {
+				t.Fatalf("%v: delay %v outside of [1, %v]\n", spec, delay, model.MaxDelay())
+			}
+		}
+	}
+	for _, spec := range []string{"fixed:0", "uniform:3:2", "trace:1,x", "trace:", "bimodal:1:20:1.5", "bimodal:1:20:-0.1", "gaussian:1"} {
+		if _, err := parseDelayModel(spec); err == nil {
+			t.Fatalf("Expected %v to be rejected\n", spec)
+		}
+	}
+	// The drain logic must wait for the slowest link
+	sim := NewSimulator(testSeed)
+	readTopology("2nodes.top", sim)
+	sim.SetLinkDelay("N1", "N2", NewTraceDelay([]int{1, 12}))
+	if sim.MaxDelay() != 12 {
+		t.Fatalf("Expected a max delay of 12, got %v\n", sim.MaxDelay())
+	}
+}
+
+// Two simulators with the same seed run side by side without interfering
+func TestSameSeedSameSnapshots(t *testing.T) {
+	results := make(chan []*SnapshotState, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			sim := NewSimulator(testSeed)
+			readTopology("10nodes.top", sim)
+			sim.SetLinkDelay("N1", "N2", NewExponentialDelay(3, 15))
+			snapshots := injectEvents("10nodes.events", sim)
+			sortSnapshots(snapshots)
+			results <- snapshots
+		}()
+	}
+	first, second := <-results, <-results
+	for i := range first {
+		assertEqual(first[i], second[i])
+	}
+}
+
+// A large ring with slow links: the scheduler must skip the idle steps
+// and only visit the servers with a message to deliver
+func TestLargeRingSkipsIdleTicks(t *testing.T) {
+	const numServers = 1000
+	const delay = 1000
+	sim := NewSimulator(testSeed)
+	sim.SetDelayModel(NewFixedDelay(delay))
+	sim.logger.NewEpoch(sim.time)
+	for i := 0; i < numServers; i++ {
+		sim.AddServer(fmt.Sprintf("N%v", i), 10)
+	}
+	for i := 0; i < numServers; i++ {
+		sim.AddForwardLink(fmt.Sprintf("N%v", i), fmt.Sprintf("N%v", (i+1)%numServers))
+	}
+	for i := 0; i < numServers; i += 100 {
+		sim.InjectEvent(PassTokenEvent{fmt.Sprintf("N%v", i), fmt.Sprintf("N%v", i+1), 3})
+	}
+	sim.InjectEvent(SnapshotEvent{"N0"})
+	snapshots := make(chan *SnapshotState)
+	go func() { snapshots <- sim.CollectSnapshot(0) }()
+	var snap *SnapshotState
+	for snap == nil {
+		select {
+		case snap = <-snapshots:
+		default:
+			if !sim.Step() {
+				snap = <-snapshots
+			}
+		}
+	}
+	for sim.Step() {
+	}
+	checkTokens(sim, []*SnapshotState{snap})
+	// The marker goes around the whole ring, one link at a time
+	if sim.time < numServers*delay {
+		t.Fatalf("Expected the snapshot to take at least %v steps, took %v\n", numServers*delay, sim.time)
+	}
+	if len(sim.logger.epochs) > 2*numServers {
+		t.Fatalf("Expected idle steps to be skipped, logged %v epochs over %v steps\n",
+			len(sim.logger.epochs), sim.time)
+	}
+}
+
+// Messages blocked on full links are delivered in order, and the snapshots
+// stay consistent but take longer to complete
+func Test8NodesBoundedLinksBlock(t *testing.T) {
+	durations := make([]int, 0)
+	for _, top := range []string{"8nodes.top", "8nodes-capacity.top"} {
+		sim := NewSimulator(testSeed)
+		readTopology(top, sim)
+		snapshots := injectEvents("8nodes-concurrent-snapshots.events", sim)
+		checkTokens(sim, snapshots)
+		total := 0
+		for _, snap := range snapshots {
+			total += sim.SnapshotDuration(snap.id)
+		}
+		durations = append(durations, total)
+		if top == "8nodes-capacity.top" && sim.Stats().blocked == 0 {
+			t.Fatalf("Expected some messages to be blocked: %v\n", sim.Stats())
+		}
+	}
+	if durations[1] <= durations[0] {
+		t.Fatalf("Expected the snapshots to take longer on bounded links, took %v vs %v steps\n",
+			durations[1], durations[0])
+	}
+}
+
+// Fill the link from N1 to N2 and take a snapshot, returning the simulator
+func fillBoundedLink(policy FullLinkPolicy) (*Simulator, *SnapshotState) {
+	sim := NewSimulator(testSeed)
+	sim.SetFullLinkPolicy(policy)
+	sim.logger.NewEpoch(sim.time)
+	sim.AddServer("N1", 10)
+	sim.AddServer("N2", 0)
+	sim.AddForwardLink("N1", "N2")
+	sim.AddForwardLink("N2", "N1")
+	sim.SetLinkCapacity("N1", "N2", 1)
+	for i := 0; i < 3; i++ {
+		sim.InjectEvent(PassTokenEvent{"N1", "N2", 2})
+	}
+	// The marker to N2 finds the link full too
+	sim.InjectEvent(SnapshotEvent{"N1"})
+	snapshots := make(chan *SnapshotState)
+	go func() { snapshots <- sim.CollectSnapshot(0) }()
+	var snap *SnapshotState
+	for snap == nil {
+		select {
+		case snap = <-snapshots:
+		default:
+			if !sim.Step() {
+				snap = <-snapshots
+			}
+		}
+	}
+	for sim.Step() {
+	}
+	return sim, snap
+}
+
+func TestBoundedLinkDrop(t *testing.T) {
+	sim, snap := fillBoundedLink(DropWhenFull)
+	if sim.Stats().dropped != 2 {
+		t.Fatalf("Expected 2 dropped messages, got %v\n", sim.Stats())
+	}
+	// The dropped tokens are lost, the rest is delivered
+	if sim.servers["N1"].Tokens != 4 || sim.servers["N2"].Tokens != 2 {
+		t.Fatalf("Expected N1 4 and N2 2 tokens, got %v and %v\n",
+			sim.servers["N1"].Tokens, sim.servers["N2"].Tokens)
+	}
+	checkTokens(sim, []*SnapshotState{snap})
+}
+
+func TestBoundedLinkFail(t *testing.T) {
+	sim, snap := fillBoundedLink(FailWhenFull)
+	if sim.Stats().failed != 2 {
+		t.Fatalf("Expected 2 failed sends, got %v\n", sim.Stats())
+	}
+	// The sender keeps the tokens of the failed sends
+	if sim.servers["N1"].Tokens != 8 || sim.servers["N2"].Tokens != 2 {
+		t.Fatalf("Expected N1 8 and N2 2 tokens, got %v and %v\n",
+			sim.servers["N1"].Tokens, sim.servers["N2"].Tokens)
+	}
+	checkTokens(sim, []*SnapshotState{snap})
+}
+
+func TestBoundedLinkBlock(t *testing.T) {
+	sim, snap := fillBoundedLink(BlockWhenFull)
+	// Two token messages and the marker waited at the sender
+	if sim.Stats().blocked != 3 {
+		t.Fatalf("Expected 3 blocked messages, got %v\n", sim.Stats())
+	}
+	if sim.servers["N2"].Tokens != 6 {
+		t.Fatalf("Expected N2 to receive every token, got %v\n", sim.servers["N2"].Tokens)
+	}
+	checkTokens(sim, []*SnapshotState{snap})
+}
+
+// The "policy" line of the .events files sets the simulator's policies by name
+func TestPolicyOptions(t *testing.T) {
+	sim := NewSimulator(testSeed)
+	readPolicyOptions([]string{"full=fail", "crash=drop", "partition=drop", "delivery=round-robin"}, sim)
+	if sim.fullLinkPolicy != FailWhenFull || sim.crashPolicy != DropWhileCrashed ||
+		sim.partitionPolicy != DropDuringPartition || sim.deliveryPolicy != RoundRobinLinks {
+		t.Fatalf("Expected the fail, drop, drop and round-robin policies, got %v, %v, %v and %v\n",
+			sim.fullLinkPolicy, sim.crashPolicy, sim.partitionPolicy, sim.deliveryPolicy)
+	}
+	if _, err := parseFullLinkPolicy("wait"); err == nil {
+		t.Fatalf("Expected an unknown full link policy to be rejected\n")
+	}
+	if _, err := parseCrashPolicy("queue"); err == nil {
+		t.Fatalf("Expected an unknown crash policy to be rejected\n")
+	}
+	if _, err := parsePartitionPolicy("buffer"); err == nil {
+		t.Fatalf("Expected an unknown partition policy to be rejected\n")
+	}
+	if _, err := parseDeliveryPolicy("fifo"); err == nil {
+		t.Fatalf("Expected an unknown delivery policy to be rejected\n")
+	}
+}
+
+// The reliable delivery layer hides the faults of the links from every algorithm
+func Test8NodesLossyLinksReliableDelivery(t *testing.T) {
+	for _, algorithm := range []SnapshotAlgorithm{ChandyLamport, LaiYang, Mattern} {
+		sim := NewSimulator(testSeed)
+		sim.SetAlgorithm(algorithm)
+		sim.SetReliableDelivery(true)
+		readTopology("8nodes-lossy.top", sim)
+		snapshots := injectEvents("8nodes-concurrent-snapshots.events", sim)
+		if len(snapshots) != 5 {
+			t.Fatalf("%v: expected 5 snapshots, got %v\n", algorithm, len(snapshots))
+		}
+		checkTokens(sim, snapshots)
+		stats := sim.Stats()
+		if stats.lost == 0 || stats.duplicated == 0 || stats.retransmitted == 0 || stats.discarded == 0 {
+			t.Fatalf("%v: expected faults to be injected and recovered from: %v\n", algorithm, stats)
+		}
+	}
+}
+
+// Every message is delivered twice by the link, and exactly once by the reliable delivery layer
+func TestReliableDeliveryDiscardsDuplicates(t *testing.T) {
+	sim := NewSimulator(testSeed)
+	sim.SetReliableDelivery(true)
+	readTopology("3nodes.top", sim)
+	for _, src := range getSortedKeys(sim.servers) {
+		for _, dest := range sim.servers[src].getSortedLinks() {
+			sim.SetLinkDuplication(src, dest, 1)
+		}
+	}
+	snapshots := injectEvents("3nodes-bidirectional-messages.events", sim)
+	checkTokens(sim, snapshots)
+	if sim.Stats().duplicated == 0 || sim.Stats().discarded < sim.Stats().duplicated {
+		t.Fatalf("Expected every duplicate to be discarded: %v\n", sim.Stats())
+	}
+}
+
+// The snapshots a crash prevents from completing fail with the missing servers,
+// and the snapshots taken after the recovery are consistent
+func Test3NodesCrashAndRecover(t *testing.T) {
+	expectedTokens := map[CrashPolicy]int{BufferWhileCrashed: 2, DropWhileCrashed: 0}
+	for policy, tokens := range expectedTokens {
+		sim := NewSimulator(testSeed)
+		sim.SetCrashPolicy(policy)
+		readTopology("3nodes.top", sim)
+		snapshots := injectEvents("3nodes-crash.events", sim)
+		sortSnapshots(snapshots)
+		if len(snapshots) != 3 {
+			t.Fatalf("%v: expected 3 snapshots, got %v\n", policy, len(snapshots))
+		}
+		for _, snap := range snapshots[:2] {
+			if !snap.Failed() || !containsString(snap.missing, "N3") {
+				t.Fatalf("%v: expected snapshot %v to fail without N3, missing %v\n",
+					policy, snap.id, snap.missing)
+			}
+		}
+		// The snapshot started while N3 was down never reached any server
+		if len(snapshots[1].missing) != 3 {
+			t.Fatalf("%v: expected snapshot 1 to miss every server, missing %v\n", policy, snapshots[1].missing)
+		}
+		if snapshots[2].Failed() {
+			t.Fatalf("%v: expected snapshot 2 to complete, missing %v\n", policy, snapshots[2].missing)
+		}
+		checkTokens(sim, snapshots)
+		if sim.servers["N3"].Tokens != tokens {
+			t.Fatalf("%v: expected N3 to end with %v tokens, got %v\n", policy, tokens, sim.servers["N3"].Tokens)
+		}
+		if (policy == DropWhileCrashed) != (sim.Stats().crashDropped > 0) {
+			t.Fatalf("%v: unexpected drops at the crashed server: %v\n", policy, sim.Stats())
+		}
+	}
+}
+
+// A token dropped at a crashed server is not counted by the control messages
+// of the snapshots taken after the recovery, which complete
+func Test3NodesCrashDropCounting(t *testing.T) {
+	for _, algorithm := range []SnapshotAlgorithm{LaiYang, Mattern} {
+		sim := NewSimulator(testSeed)
+		sim.SetAlgorithm(algorithm)
+		readTopology("3nodes.top", sim)
+		snapshots := injectEvents("3nodes-crash-drop.events", sim)
+		if sim.Stats().crashDropped != 1 {
+			t.Fatalf("%v: expected 1 message dropped at N2, got %v\n", algorithm, sim.Stats())
+		}
+		if snapshots[0].Failed() {
+			t.Fatalf("%v: expected the snapshot to complete, missing %v\n", algorithm, snapshots[0].missing)
+		}
+		checkTokens(sim, snapshots)
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, other := range values {
+		if other == value {
+			return true
+		}
+	}
+	return false
+}
+
+// A snapshot stalls while its markers cannot cross a partition and completes after the heal
+func Test8NodesPartitionQueue(t *testing.T) {
+	sim := NewSimulator(testSeed)
+	readTopology("8nodes.top", sim)
+	snapshots := injectEvents("8nodes-partition.events", sim)
+	if len(snapshots) != 1 || snapshots[0].Failed() {
+		t.Fatalf("Expected 1 completed snapshot, got %v\n", snapshots)
+	}
+	if duration := sim.SnapshotDuration(0); duration < 20 {
+		t.Fatalf("Expected the snapshot to stall until the heal, took %v steps\n", duration)
+	}
+	checkTokens(sim, snapshots)
+	if simulatorTokens(sim) != 40 {
+		t.Fatalf("Expected 40 tokens after the heal, got %v\n", simulatorTokens(sim))
+	}
+	// The partition and the heal are in the log
+	found := make(map[string]bool)
+	for _, epoch := range sim.logger.epochs {
+		for _, event := range epoch.events {
+			switch event.event.(type) {
+			case PartitionEvent:
+				found["partition"] = true
+			case HealEvent:
+				found["heal"] = true
+			}
+		}
+	}
+	if !found["partition"] || !found["heal"] {
+		t.Fatalf("Expected the partition and the heal to be logged, found %v\n", found)
+	}
+}
+
+// Dropping a marker at the partition fails the snapshot, unless the reliable
+// delivery layer sends it again after the heal
+func Test8NodesPartitionDrop(t *testing.T) {
+	for _, reliable := range []bool{false, true} {
+		sim := NewSimulator(testSeed)
+		sim.SetPartitionPolicy(DropDuringPartition)
+		sim.SetReliableDelivery(reliable)
+		readTopology("8nodes.top", sim)
+		snapshots := injectEvents("8nodes-partition.events", sim)
+		if sim.Stats().partitionDropped == 0 {
+			t.Fatalf("Expected messages to be dropped by the partition: %v\n", sim.Stats())
+		}
+		if snapshots[0].Failed() != !reliable {
+			t.Fatalf("Reliable delivery %v: unexpected snapshot, missing %v\n", reliable, snapshots[0].missing)
+		}
+		if !reliable && !containsString(snapshots[0].missing, "N5") {
+			t.Fatalf("Expected N5 to miss the snapshot, missing %v\n", snapshots[0].missing)
+		}
+		checkTokens(sim, snapshots)
+		// Only the reliable delivery layer conserves the tokens sent across the partition
+		if (simulatorTokens(sim) == 40) != reliable {
+			t.Fatalf("Reliable delivery %v: got %v tokens\n", reliable, simulatorTokens(sim))
+		}
+	}
+}
+
+// A token dropped at the partition is not counted by the control messages
+// of the snapshots taken after the heal, which complete
+func Test3NodesPartitionDropCounting(t *testing.T) {
+	for _, algorithm := range []SnapshotAlgorithm{LaiYang, Mattern} {
+		sim := NewSimulator(testSeed)
+		sim.SetAlgorithm(algorithm)
+		readTopology("3nodes.top", sim)
+		snapshots := injectEvents("3nodes-partition-drop.events", sim)
+		if sim.Stats().partitionDropped != 1 {
+			t.Fatalf("%v: expected 1 message dropped by the partition, got %v\n", algorithm, sim.Stats())
+		}
+		if snapshots[0].Failed() {
+			t.Fatalf("%v: expected the snapshot to complete, missing %v\n", algorithm, snapshots[0].missing)
+		}
+		checkTokens(sim, snapshots)
+	}
+}
+
+func TestParsePartition(t *testing.T) {
+	groups, err := parsePartition("N1,N2 | N3")
+	if err != nil || len(groups) != 2 || len(groups[0]) != 2 || groups[1][0] != "N3" {
+		t.Fatalf("Unexpected partition %v, %v\n", groups, err)
+	}
+	for _, spec := range []string{"N1,N2", "N1 | N1", "N1, | N2"} {
+		if _, err := parsePartition(spec); err == nil {
+			t.Fatalf("Expected %q to be rejected\n", spec)
+		}
+	}
+}
+
+// Links added and removed during the snapshots keep them consistent,
+// and the tokens queued on a removed link go back to the sender
+func Test8NodesAddRemoveLinks(t *testing.T) {
+	sim := NewSimulator(testSeed)
+	readTopology("8nodes.top", sim)
+	snapshots := injectEvents("8nodes-links.events", sim)
+	if len(snapshots) != 2 {
+		t.Fatalf("Expected 2 snapshots, got %v\n", len(snapshots))
+	}
+	for _, snap := range snapshots {
+		if snap.Failed() {
+			t.Fatalf("Expected snapshot %v to complete, missing %v\n", snap.id, snap.missing)
+		}
+	}
+	checkTokens(sim, snapshots)
+	if simulatorTokens(sim) != 40 {
+		t.Fatalf("Expected the removed links to give back their tokens, got %v tokens\n", simulatorTokens(sim))
+	}
+	if _, ok := sim.servers["N4"].outboundLinks["N5"]; ok {
+		t.Fatalf("Expected the link N4 -> N5 to be removed\n")
+	}
+}
+
+// A snapshot covers the servers in place when it started: a server added later takes
+// no part in it, and a member removed before completing it fails it
+func Test3NodesAddRemoveServers(t *testing.T) {
+	sim := NewSimulator(testSeed)
+	readTopology("3nodes.top", sim)
+	snapshots := injectEvents("3nodes-servers.events", sim)
+	sortSnapshots(snapshots)
+	if len(snapshots) != 3 {
+		t.Fatalf("Expected 3 snapshots, got %v\n", len(snapshots))
+	}
+	if len(snapshots[0].tokens) != 3 || snapshotTokens(snapshots[0]) != 13 {
+		t.Fatalf("Expected snapshot 0 to cover the 3 initial servers and their 13 tokens, got %v\n",
+			snapshots[0].tokens)
+	}
+	if !snapshots[1].Failed() || !containsString(snapshots[1].missing, "N3") {
+		t.Fatalf("Expected snapshot 1 to fail without N3, missing %v\n", snapshots[1].missing)
+	}
+	if snapshots[2].Failed() || len(snapshots[2].tokens) != 3 {
+		t.Fatalf("Expected snapshot 2 to cover N1, N2 and N4, got %v\n", snapshots[2].tokens)
+	}
+	if _, ok := snapshots[2].tokens["N4"]; !ok {
+		t.Fatalf("Expected snapshot 2 to cover N4, got %v\n", snapshots[2].tokens)
+	}
+	// The tokens of N4 joined after snapshot 0
+	checkTokens(sim, snapshots[2:])
+}
+
+// Every delivery policy keeps the snapshots consistent and is recorded in the log
+func Test8NodesDeliveryPolicies(t *testing.T) {
+	for _, policy := range []DeliveryPolicy{FirstReadyLink, RoundRobinLinks, AllReady, RandomLink, OnePerDestination} {
+		sim := NewSimulator(testSeed)
+		sim.SetDeliveryPolicy(policy)
+		readTopology("8nodes.top", sim)
+		snapshots := injectEvents("8nodes-concurrent-snapshots.events", sim)
+		if len(snapshots) != 5 {
+			t.Fatalf("%v: expected 5 snapshots, got %v\n", policy, len(snapshots))
+		}
+		checkTokens(sim, snapshots)
+		if !containsString(sim.logger.header, "Delivery: "+policy.String()) {
+			t.Fatalf("%v: expected the policy in the log header, got %v\n", policy, sim.logger.header)
+		}
+	}
+}
+
+// Which messages ready at the same time step are delivered together
+func TestDeliveryPolicyReadyMessages(t *testing.T) {
+	// N1 sends to N2 and N3, and N2 to N3: key = policy, value = tokens N3 receives in one step
+	expected := map[DeliveryPolicy]int{FirstReadyLink: 1, AllReady: 3, OnePerDestination: 2}
+	for policy, tokens := range expected {
+		sim := NewSimulator(testSeed)
+		sim.SetDeliveryPolicy(policy)
+		sim.SetDelayModel(NewFixedDelay(1))
+		sim.logger.NewEpoch(sim.time)
+		sim.AddServer("N1", 10)
+		sim.AddServer("N2", 10)
+		sim.AddServer("N3", 0)
+		sim.AddForwardLink("N1", "N2")
+		sim.AddForwardLink("N1", "N3")
+		sim.AddForwardLink("N2", "N3")
+		sim.InjectEvent(PassTokenEvent{"N1", "N2", 1})
+		sim.InjectEvent(PassTokenEvent{"N1", "N3", 2})
+		sim.InjectEvent(PassTokenEvent{"N2", "N3", 1})
+		sim.Tick()
+		// N1 always delivers to N2 first
+		if sim.servers["N2"].Tokens != 10 || sim.servers["N3"].Tokens != tokens {
+			t.Fatalf("%v: expected N2 to have 10 and N3 %v tokens, got %v and %v\n",
+				policy, tokens, sim.servers["N2"].Tokens, sim.servers["N3"].Tokens)
+		}
+	}
+	// Round robin alternates between the links of N1
+	sim := NewSimulator(testSeed)
+	sim.SetDeliveryPolicy(RoundRobinLinks)
+	sim.SetDelayModel(NewFixedDelay(1))
+	readTopology("3nodes.top", sim)
+	for i := 0; i < 2; i++ {
+		sim.InjectEvent(PassTokenEvent{"N1", "N2", 1})
+		sim.InjectEvent(PassTokenEvent{"N1", "N3", 1})
+	}
+	sim.TickN(2)
+	if sim.servers["N2"].Tokens != 4 || sim.servers["N3"].Tokens != 1 {
+		t.Fatalf("Expected round robin to deliver to N2 then N3, got %v and %v\n",
+			sim.servers["N2"].Tokens, sim.servers["N3"].Tokens)
+	}
+}
+
+// Same as `runConsistencyTest`, but with the servers running concurrently in the live runtime.
+// The snapshots depend on the scheduling of the goroutines, so only their tokens are checked.
+func runLiveTest(t *testing.T, configure func(sim *Simulator), topFile string, eventsFile string, numSnaps int) {
+	t.Parallel()
+	sim := NewSimulator(testSeed)
+	configure(sim)
+	readTopology(topFile, sim)
+	sim.StartLive(time.Millisecond)
+	actualSnaps := injectEvents(eventsFile, sim)
+	sim.StopLive()
+	if len(actualSnaps) != numSnaps {
+		t.Fatalf("预期有 %v 个snapshot(s), 得到了got %v\n", numSnaps, len(actualSnaps))
+	}
+	for _, snap := range actualSnaps {
+		if len(snap.tokens) != len(sim.servers) {
+			t.Fatalf("Snapshot %v: expected the tokens of %v servers, got %v\n",
+				snap.id, len(sim.servers), tokensString(snap.tokens, ""))
+		}
+	}
+	checkTokens(sim, actualSnaps)
+}
+
+func Test8NodesLive(t *testing.T) {
+	runLiveTest(t, func(sim *Simulator) {}, "8nodes.top", "8nodes-live.events", 5)
+}
+
+func Test10NodesLive(t *testing.T) {
+	runLiveTest(t, func(sim *Simulator) {}, "10nodes.top", "10nodes-live.events", 9)
+}
+
+func Test10NodesInBandTerminationLive(t *testing.T) {
+	runLiveTest(t, inBandTermination, "10nodes.top", "10nodes-live.events", 9)
+}
+
+func Test8NodesLaiYangLive(t *testing.T) {
+	runLiveTest(t, laiYang, "8nodes.top", "8nodes-live.events", 5)
+}
+
+func Test10NodesMatternLive(t *testing.T) {
+	runLiveTest(t, mattern, "10nodes.top", "10nodes-live.events", 9)
+}
+
+// Run every server of the topology as a node on a loopback TCP port, replay the
+// "send", "snapshot" and "tick" events, and check the tokens of the merged snapshots
+func runNodesTest(t *testing.T, algorithm SnapshotAlgorithm, topFile string, eventsFile string, numSnaps int) {
+	t.Parallel()
+	// The topology, and the tokens the snapshots must add up to
+	sim := NewSimulator(testSeed)
+	readTopology(topFile, sim)
+	nodes := make(map[string]*Node)
+	for _, server := range sim.sortedServers() {
+		node, err := NewNode(server.Id, server.Tokens, "127.0.0.1:0")
+		checkError(err)
+		nodes[server.Id] = node
+		nodes[server.Id].SetAlgorithm(algorithm)
+	}
+	for _, server := range sim.sortedServers() {
+		for _, dest := range server.getSortedLinks() {
+			nodes[server.Id].AddOutboundLink(dest, nodes[dest].Addr())
+			nodes[dest].AddInboundLink(server.Id)
+		}
+	}
+	b, err := ioutil.ReadFile(path.Join(testDir, eventsFile))
+	checkError(err)
+	numStarted := 0
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		parts := strings.Fields(line)
+		switch parts[0] {
+		case "send":
+			tokens, err := strconv.Atoi(parts[3])
+			checkError(err)
+			nodes[parts[1]].SendTokens(tokens, parts[2])
+		case "snapshot":
+			nodes[parts[1]].StartSnapshot(numStarted)
+			numStarted++
+		case "tick":
+			numTicks := 1
+			if len(parts) > 1 {
+				numTicks, err = strconv.Atoi(parts[1])
+				checkError(err)
+			}
+			time.Sleep(time.Duration(numTicks) * time.Millisecond)
+		}
+	}
+	if numStarted != numSnaps {
+		t.Fatalf("预期有 %v 个snapshot(s), 得到了got %v\n", numSnaps, numStarted)
+	}
+	snaps := make([]*SnapshotState, 0)
+	for id := 0; id < numStarted; id++ {
+		parts := make([]*SnapshotState, 0)
+		for _, server := range sim.sortedServers() {
+			parts = append(parts, nodes[server.Id].CollectSnapshot(id))
+		}
+		snap := MergeSnapshots(parts)
+		if len(snap.tokens) != len(nodes) {
+			t.Fatalf("Snapshot %v: expected the tokens of %v servers, got %v\n",
+				id, len(nodes), tokensString(snap.tokens, ""))
+		}
+		snaps = append(snaps, snap)
+	}
+	for _, node := range nodes {
+		node.Close()
+	}
+	checkTokens(sim, snaps)
+}
+
+func Test8NodesTCP(t *testing.T) {
+	runNodesTest(t, ChandyLamport, "8nodes.top", "8nodes-live.events", 5)
+}
+
+func Test10NodesTCP(t *testing.T) {
+	runNodesTest(t, ChandyLamport, "10nodes.top", "10nodes-live.events", 9)
+}
+
+func Test8NodesLaiYangTCP(t *testing.T) {
+	runNodesTest(t, LaiYang, "8nodes.top", "8nodes-live.events", 5)
+}
+
+func Test10NodesMatternTCP(t *testing.T) {
+	runNodesTest(t, Mattern, "10nodes.top", "10nodes-live.events", 9)
+}
+
+// A peer closing its connection closes the link, not the node
+func TestNodeClosesBrokenLinks(t *testing.T) {
+	node, err := NewNode("N1", 100, "127.0.0.1:0")
+	checkError(err)
+	defer node.Close()
+	if _, err := NewNode("N2", 0, node.Addr()); err == nil {
+		t.Fatalf("Expected a node on an address in use to fail\n")
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	checkError(err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	node.AddOutboundLink("N2", listener.Addr().String())
+	link := node.transport.links["N2"]
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		node.SendTokens(1, "N2")
+		link.lock.Lock()
+		closed := link.closed
+		link.lock.Unlock()
+		if closed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the link to N2 to be closed\n")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The node still runs
+	if node.Tokens() >= 100 {
+		t.Fatalf("Expected N1 to have sent tokens, has %v\n", node.Tokens())
+	}
+}
+
+// A bad message from a peer closes its connection, not the node
+func TestNodeClosesBadConnections(t *testing.T) {
+	node, err := NewNode("N2", 0, "127.0.0.1:0")
+	checkError(err)
+	defer node.Close()
+	node.AddInboundLink("N1")
+	token := func(src string) []byte {
+		frame, err := EncodeMessage(src, TokenMessage{numTokens: 2})
+		checkError(err)
+		return frame
+	}
+	cases := map[string][][]byte{
+		"malformed":      {{0xff}},
+		"other sender":   {token("N1"), token("N3")},
+		"without a link": {token("N3")},
+	}
+	for name, frames := range cases {
+		conn, err := net.Dial("tcp", node.Addr())
+		checkError(err)
+		for _, frame := range frames {
+			checkError(writeFrame(conn, frame))
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("%v: expected the node to close the connection, got %v\n", name, err)
+		}
+		conn.Close()
+	}
+	// Only the message from N1 before the other sender was delivered
+	if node.Tokens() != 2 {
+		t.Fatalf("Expected N2 to receive 2 tokens, got %v\n", node.Tokens())
+	}
+}
+
+// Run every server as a node in its own process, using this test binary as the node
+func TestCluster(t *testing.T) {
+	t.Parallel()
+	cluster, err := StartCluster(path.Join(testDir, "8nodes.top"), LaiYang, time.Millisecond,
+		os.Args[0], "-test.run=^TestClusterNodeProcess$", "--")
+	checkError(err)
+	snapshots, err := cluster.Replay(path.Join(testDir, "8nodes-live.events"))
+	cluster.Close()
+	checkError(err)
+	if len(snapshots) != 5 {
+		t.Fatalf("预期有 %v 个snapshot(s), 得到了got %v\n", 5, len(snapshots))
+	}
+	checkTokens(cluster.sim, snapshots)
+	// The ".snap" files read back the same
+	dir := t.TempDir()
+	checkError(WriteSnapshots(dir, "8nodes-live.events", snapshots))
+	for _, snap := range snapshots {
+		b, err := ioutil.ReadFile(path.Join(dir, fmt.Sprintf("8nodes-live%v.snap", snap.id)))
+		checkError(err)
+		assertEqual(snap, parseSnapshot(string(b)))
+	}
+}
+
+// The process of a node started by `TestCluster`, does nothing otherwise
+func TestClusterNodeProcess(t *testing.T) {
+	args := os.Args
+	for len(args) > 0 && args[0] != "--" {
+		args = args[1:]
+	}
+	if len(args) != 5 || args[1] != "node" {
+		return
+	}
+	tokens, err := strconv.Atoi(args[3])
+	checkError(err)
+	algorithm, err := ParseAlgorithm(args[4])
+	checkError(err)
+	checkError(ServeNode(args[2], tokens, algorithm, os.Stdout))
+	os.Exit(0)
+}
+
+// The collected snapshots are saved as they complete and read back the same
+func TestSnapshotStore(t *testing.T) {
+	t.Parallel()
+	store, err := NewSnapshotStore(path.Join(t.TempDir(), "snapshots"))
+	checkError(err)
+	sim := NewSimulator(testSeed)
+	sim.SetSnapshotStore(store)
+	readTopology("8nodes.top", sim)
+	snapshots := injectEvents("8nodes-concurrent-snapshots.events", sim)
+	ids, err := store.List()
+	checkError(err)
+	if !reflect.DeepEqual(ids, []int{0, 1, 2, 3, 4}) {
+		t.Fatalf("Expected snapshots 0 to 4 in the store, got %v\n", ids)
+	}
+	for _, snap := range snapshots {
+		loaded, err := store.Load(snap.id)
+		checkError(err)
+		assertEqual(snap, loaded)
+		assertEqual(readSnapshot(fmt.Sprintf("8nodes-concurrent-snapshots%v.snap", snap.id)), loaded)
+		b, err := ioutil.ReadFile(path.Join(store.dir, fmt.Sprintf("%v.snap", snap.id)))
+		checkError(err)
+		assertEqual(snap, parseSnapshot(string(b)))
+	}
+	// Messages other than tokens and failed snapshots only survive in the JSON form
+	failed := &SnapshotState{
+		id:       7,
+		tokens:   make(map[string]int),
+		messages: []*SnapshotMessage{{"N1", "N2", MarkerMessage{7, 0}}},
+		missing:  []string{}}
+	checkError(store.Save(failed))
+	loaded, err := store.Load(7)
+	checkError(err)
+	if !reflect.DeepEqual(loaded, failed) {
+		t.Fatalf("Expected %+v, got %+v\n", failed, loaded)
+	}
+	// The snapshots with the lowest IDs go first
+	store.SetRetention(2)
+	checkError(store.Save(snapshots[0]))
+	ids, err = store.List()
+	checkError(err)
+	if !reflect.DeepEqual(ids, []int{4, 7}) {
+		t.Fatalf("Expected snapshots 4 and 7 to be kept, got %v\n", ids)
+	}
+	if _, err := store.Load(0); !os.IsNotExist(err) {
+		t.Fatalf("Expected snapshot 0 to be removed, got %v\n", err)
+	}
+	// No temporary file is left behind
+	files, err := ioutil.ReadDir(store.dir)
+	checkError(err)
+	if len(files) != 4 {
+		t.Fatalf("Expected 2 snapshots in 4 files, got %v files\n", len(files))
+	}
+}
+
+var restoreSnaps = []string{"3nodes-restore0.snap", "3nodes-restore1.snap", "3nodes-restore2.snap"}
+
+// Snapshot 1 records the messages put back on the links by restoring snapshot 0
+func Test3NodesRestore(t *testing.T) {
+	runTest(t, "3nodes.top", "3nodes-restore.events", restoreSnaps)
+}
+
+func Test3NodesRestoreLaiYang(t *testing.T) {
+	runTestWith(t, laiYang, "3nodes.top", "3nodes-restore.events", restoreSnaps)
+}
+
+func Test3NodesRestoreMattern(t *testing.T) {
+	runTestWith(t, mattern, "3nodes.top", "3nodes-restore.events",
+		[]string{"3nodes-restore-mattern0.snap", "3nodes-restore-mattern1.snap", "3nodes-restore-mattern2.snap"})
+}
+
+// The restored messages a bounded link has no room for wait at the sender
+func TestRestoreBoundedLink(t *testing.T) {
+	sim := NewSimulator(testSeed)
+	readTopology("2nodes-capacity.top", sim)
+	sim.Restore(parseSnapshot("0\nN1 0\nN2 0\nN1 N2 token(1)\nN1 N2 token(2)\nN1 N2 token(3)\n"))
+	link := sim.getLink("N1", "N2")
+	if link.events.Len() != 1 || link.backlog.Len() != 2 {
+		t.Fatalf("Expected 1 message on the link and 2 at the sender, got %v and %v\n",
+			link.events.Len(), link.backlog.Len())
+	}
+	for sim.Step() {
+	}
+	if sim.servers["N2"].Tokens != 6 {
+		t.Fatalf("Expected N2 to receive every restored token, got %v\n", sim.servers["N2"].Tokens)
+	}
+}
+
+// A stored snapshot restored on a new simulator puts the tokens and the in-flight
+// messages back, and the run conserves the tokens from there
+func TestRestoreFromStore(t *testing.T) {
+	t.Parallel()
+	store, err := NewSnapshotStore(t.TempDir())
+	checkError(err)
+	sim := NewSimulator(testSeed)
+	sim.SetSnapshotStore(store)
+	readTopology("8nodes.top", sim)
+	injectEvents("8nodes-concurrent-snapshots.events", sim)
+	snap, err := store.Load(1)
+	checkError(err)
+
+	restored := NewSimulator(testSeed)
+	readTopology("8nodes.top", restored)
+	restored.Restore(snap)
+	onLinks := make([]*SnapshotMessage, 0)
+	for _, server := range restored.sortedServers() {
+		if server.Tokens != snap.tokens[server.Id] {
+			t.Fatalf("Expected %v to have %v tokens, got %v\n", server.Id, snap.tokens[server.Id], server.Tokens)
+		}
+		for _, dest := range server.getSortedLinks() {
+			for _, e := range server.outboundLinks[dest].events.Items() {
+				e := e.(SendMessageEvent)
+				onLinks = append(onLinks, &SnapshotMessage{e.src, e.dest, e.message})
+			}
+		}
+	}
+	sortMessages := func(messages []*SnapshotMessage) string {
+		strs := strings.Split(messagesString(messages, ""), "\n")
+		sort.Strings(strs)
+		return strings.Join(strs, "\n")
+	}
+	if sortMessages(onLinks) != sortMessages(snap.messages) {
+		t.Fatalf("Expected on the links:\n%v\ngot:\n%v\n", messagesString(snap.messages, "\t"), messagesString(onLinks, "\t"))
+	}
+	restored.InjectEvent(PassTokenEvent{"N1", "N2", 1})
+	restored.InjectEvent(SnapshotEvent{"N5"})
+	snaps := []*SnapshotState{snap}
+	for restored.Step() {
+	}
+	snaps = append(snaps, restored.CollectSnapshot(0))
+	checkTokens(restored, snaps)
+}
+
+// Every message of the protocol survives both forms of the codec
+func TestMessageEncoding(t *testing.T) {
+	messages := []interface{}{
+		TokenMessage{numTokens: 3},
+		TokenMessage{3, []int{0, 2}, map[string]int{"N1": 4, "N2": 1}},
+		MarkerMessage{2, 7},
+		ControlMessage{1, 4},
+		CutMessage{VectorCut{1, "N2", 5}},
+		CutAckMessage{1, "N3", []string{"N1", "N4"}, nil},
+		CutAckMessage{1, "N3", []string{"N1"}, []string{"N3", "N4"}},
+		SnapshotReportMessage{1, "N3", []string{"N1", "N4"}, nil},
+		SnapshotReportMessage{1, "N3", []string{"N1", "N4"}, []string{"N3", "N4"}},
+		// A server without outbound links
+		CutAckMessage{1, "N3", nil, nil},
+		SnapshotReportMessage{1, "N3", nil, nil},
+		// The states exchanged when merging snapshots
+		RegionReportMessage{3, ServerState{"N2", 4, "N6", nil, nil, 0, nil}, nil},
+		RegionReportMessage{3, ServerState{"N5", 3, "N6", []string{"N4", "N6"}, map[string]int{"N4": 4}, 7,
+			[]*SnapshotMessage{{"N4", "N5", TokenMessage{numTokens: 2}}}}, []string{"N7"}},
+		RegionResultMessage{4, 3, []ServerState{{"N6", 3, "", []string{"N5"}, nil, 5, nil}}, []string{"N5", "N4"}, nil},
+		DataPacket{4, MarkerMessage{2, 0}},
+		AckPacket{5},
+		SendMessageEvent{"N1", "N2", TokenMessage{numTokens: 2}, 9},
+	}
+	for _, message := range messages {
+		data, err := EncodeMessage("N1", message)
+		checkError(err)
+		sender, decoded, err := DecodeMessage(data)
+		checkError(err)
+		if sender != "N1" || !reflect.DeepEqual(decoded, message) {
+			t.Fatalf("Expected %+v from N1, got %+v from %v\n", message, decoded, sender)
+		}
+		data, err = EncodeMessageJSON("N1", message)
+		checkError(err)
+		sender, decoded, err = DecodeMessageJSON(data)
+		checkError(err)
+		if sender != "N1" || !reflect.DeepEqual(decoded, message) {
+			t.Fatalf("Expected %+v from N1, got %+v from %v in %s\n", message, decoded, sender, data)
+		}
+	}
+	// The same message always has the same encoding
+	data, err := EncodeMessageJSON("N3", MarkerMessage{2, 7})
+	checkError(err)
+	expected := `{"version":1,"type":"marker","snapshot":2,"sender":"N3","payload":{"epoch":7}}`
+	if string(data) != expected {
+		t.Fatalf("Expected %v, got %s\n", expected, data)
+	}
+}
+
+// Messages of another version, truncated or of an unknown type are rejected
+func TestMessageEncodingErrors(t *testing.T) {
+	data, err := EncodeMessage("N1", MarkerMessage{2, 7})
+	checkError(err)
+	data[0] = codecVersion + 1
+	if _, _, err := DecodeMessage(data); !errors.Is(err, ErrUnknownVersion) {
+		t.Fatalf("Expected an unknown version, got %v\n", err)
+	}
+	_, _, err = DecodeMessageJSON([]byte(`{"version":2,"type":"marker","snapshot":2,"payload":{}}`))
+	if !errors.Is(err, ErrUnknownVersion) {
+		t.Fatalf("Expected an unknown version, got %v\n", err)
+	}
+	data, err = EncodeMessage("N1", SnapshotReportMessage{1, "N3", []string{"N1", "N4"}, []string{"N3"}})
+	checkError(err)
+	for i := 1; i < len(data); i++ {
+		if _, _, err := DecodeMessage(data[:i]); err == nil {
+			t.Fatalf("Expected %v of %v bytes to be rejected\n", i, len(data))
+		}
+	}
+	if _, _, err := DecodeMessage([]byte{codecVersion, 0, 42, 1}); err == nil {
+		t.Fatalf("Expected an unknown type to be rejected\n")
+	}
+	if _, err := EncodeMessage("N2", SendMessageEvent{"N1", "N2", MarkerMessage{0, 0}, 1}); err == nil {
+		t.Fatalf("Expected an event to be encoded with its source as the sender\n")
+	}
+	if _, err := EncodeMessage("N1", StartSnapshot{"N1", 0}); err == nil {
+		t.Fatalf("Expected a log event to be rejected\n")
+	}
+}
+
 //-------------------------------------------------------
 func gotest(i string,string string){
 	fmt.Println("{"+i+"},"+string);
@@ -0,0 +1,225 @@
+package lamport
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ================
+//  Snapshot store
+// ================
+
+// A directory holding the completed snapshots, so that they survive the process.
+// Every snapshot is stored twice, named after its ID:
+//   - "<id>.snap", the format of the golden files, see `formatSnapshot`
+//   - "<id>.json", which also keeps the messages other than tokens and the servers
+//     missing from a failed snapshot, and is the one read back by `Load`
+//
+// Each file is written to a temporary file first and renamed, so a reader never
+// sees a partial snapshot, even if the process dies while writing it.
+//
+// 快照持久化：原子写入（临时文件加重命名），按 ID 查找，保留最近的若干个快照
+
+type SnapshotStore struct {
+	dir string
+	// Number of snapshots kept, the ones with the lowest IDs are removed first, 0 = all
+	retain int
+	// Serializes the saves, as snapshots are collected concurrently
+	lock sync.Mutex
+}
+
+// The snapshot in the JSON form, the messages in the JSON form of the codec
+type jsonSnapshot struct {
+	Id       int                   `json:"id"`
+	Tokens   map[string]int        `json:"tokens"`
+	Messages []jsonSnapshotMessage `json:"messages"`
+	Missing  []string              `json:"missing"` // null unless the snapshot failed
+}
+
+type jsonSnapshotMessage struct {
+	Src     string          `json:"src"`
+	Dest    string          `json:"dest"`
+	Message json.RawMessage `json:"message"`
+}
+
+// Prefix of the files being written
+const tempPrefix = ".tmp-"
+
+// Open the store in the given directory, creating it if needed
+func NewSnapshotStore(dir string) (*SnapshotStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &SnapshotStore{dir: dir}, nil
+}
+
+// Save every completed snapshot to the store as it is collected, nil = none.
+// Failed snapshots are not saved.
+func (sim *Simulator) SetSnapshotStore(store *SnapshotStore) {
+	sim.store = store
+}
+
+// Keep only the given number of snapshots, those with the highest IDs, 0 = keep all.
+// The policy is applied on every save.
+func (store *SnapshotStore) SetRetention(count int) {
+	if count < 0 {
+		count = 0
+	}
+	store.retain = count
+}
+
+// Write the snapshot to the store, replacing the one of the same ID if any
+func (store *SnapshotStore) Save(snap *SnapshotState) error {
+	data, err := encodeSnapshotJSON(snap)
+	if err != nil {
+		return err
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	// The JSON file is written last: a snapshot is stored once it exists
+	if err := writeFileAtomic(store.path(snap.id, ".snap"), []byte(formatSnapshot(snap))); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(store.path(snap.id, ".json"), data); err != nil {
+		return err
+	}
+	return store.applyRetention()
+}
+
+// Return the IDs of the stored snapshots, in increasing order
+func (store *SnapshotStore) List() ([]int, error) {
+	files, err := ioutil.ReadDir(store.dir)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int, 0)
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		if id, err := strconv.Atoi(strings.TrimSuffix(name, ".json")); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+// Read the snapshot of the given ID from the store
+func (store *SnapshotStore) Load(snapshotId int) (*SnapshotState, error) {
+	data, err := ioutil.ReadFile(store.path(snapshotId, ".json"))
+	if err != nil {
+		return nil, err
+	}
+	snap, err := decodeSnapshotJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("snapshot %v: %v", snapshotId, err)
+	}
+	return snap, nil
+}
+
+// Remove the snapshot of the given ID from the store
+func (store *SnapshotStore) Remove(snapshotId int) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	return store.remove(snapshotId)
+}
+
+func (store *SnapshotStore) remove(snapshotId int) error {
+	// The JSON file first, so a snapshot is never listed without its files
+	for _, ext := range []string{".json", ".snap"} {
+		if err := os.Remove(store.path(snapshotId, ext)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *SnapshotStore) applyRetention() error {
+	if store.retain == 0 {
+		return nil
+	}
+	ids, err := store.List()
+	if err != nil {
+		return err
+	}
+	for len(ids) > store.retain {
+		if err := store.remove(ids[0]); err != nil {
+			return err
+		}
+		ids = ids[1:]
+	}
+	return nil
+}
+
+func (store *SnapshotStore) path(snapshotId int, ext string) string {
+	return filepath.Join(store.dir, strconv.Itoa(snapshotId)+ext)
+}
+
+// Write the file through a temporary file in the same directory, renamed once complete
+func writeFileAtomic(fileName string, data []byte) error {
+	temp, err := ioutil.TempFile(filepath.Dir(fileName), tempPrefix+filepath.Base(fileName)+"-")
+	if err != nil {
+		return err
+	}
+	_, err = temp.Write(data)
+	if err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(temp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(temp.Name(), fileName)
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+	}
+	return err
+}
+
+func encodeSnapshotJSON(snap *SnapshotState) ([]byte, error) {
+	j := jsonSnapshot{snap.id, snap.tokens, make([]jsonSnapshotMessage, 0), snap.missing}
+	for _, msg := range snap.messages {
+		message, err := EncodeMessageJSON(msg.src, msg.message)
+		if err != nil {
+			return nil, err
+		}
+		j.Messages = append(j.Messages, jsonSnapshotMessage{msg.src, msg.dest, message})
+	}
+	return json.MarshalIndent(j, "", "\t")
+}
+
+func decodeSnapshotJSON(data []byte) (*SnapshotState, error) {
+	var j jsonSnapshot
+	if err := json.Unmarshal(data, &j); err != nil {
+		return nil, err
+	}
+	snap := SnapshotState{
+		id:       j.Id,
+		tokens:   j.Tokens,
+		messages: make([]*SnapshotMessage, 0),
+		missing:  j.Missing}
+	if snap.tokens == nil {
+		snap.tokens = make(map[string]int)
+	}
+	for _, msg := range j.Messages {
+		_, message, err := DecodeMessageJSON(msg.Message)
+		if err != nil {
+			return nil, err
+		}
+		snap.messages = append(snap.messages, &SnapshotMessage{msg.Src, msg.Dest, message})
+	}
+	return &snap, nil
+}
@@ -0,0 +1,386 @@
+package lamport
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// ===============
+//  TCP transport
+// ===============
+
+// A node runs a single server, typically as its own process. Each of its outbound links
+// is a TCP connection to the node of the destination, carrying length-prefixed frames,
+// one message per frame in the binary form of the codec, see codec.go. The connection
+// keeps the frames in order, so the links are FIFO.
+//
+// The node keeps a simulator of its own, holding its server and a stand-in for every
+// neighbor, so the server runs the same protocol code as in the simulator. Everything
+// the server does happens on the goroutine of the node. A snapshot is collected from
+// every node separately: each one only knows the tokens of its server and the messages
+// recorded on its inbound links, see `MergeSnapshots`.
+//
+// 每个节点一个服务器（通常一个进程），信道是 TCP 连接
+
+type Node struct {
+	sim       *Simulator
+	server    *Server
+	transport *TCPTransport
+	listener  net.Listener
+	// The functions run by the goroutine of the node, in order
+	inbox chan func()
+	stop  chan bool
+	done  sync.WaitGroup
+}
+
+// Sends the messages of the outbound links of a node on TCP connections
+type TCPTransport struct {
+	// key = destination server ID
+	links map[string]*tcpLink
+	stop  chan bool
+}
+
+// The messages waiting to be written to the connection of a link
+type tcpLink struct {
+	src     string
+	addr    string
+	pending []interface{}
+	lock    sync.Mutex
+	ready   *sync.Cond
+	closed  bool
+}
+
+// Longest a node waits for the node at the other end of a link to accept connections
+const dialTimeout = 10 * time.Second
+
+// Largest frame a node accepts
+const maxFrameSize = 1 << 20
+
+// Create the node running the given server, listening on the given address (e.g. "127.0.0.1:0")
+func NewNode(id string, tokens int, addr string) (*Node, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("server %v cannot listen on %v: %v", id, addr, err)
+	}
+	sim := NewSimulator(0)
+	sim.logger.NewEpoch(sim.time)
+	sim.AddServer(id, tokens)
+	sim.remote = make(map[string]bool)
+	transport := &TCPTransport{make(map[string]*tcpLink), make(chan bool)}
+	sim.transport = transport
+	node := &Node{sim, sim.servers[id], transport, listener, make(chan func()), make(chan bool), sync.WaitGroup{}}
+	node.done.Add(2)
+	go node.runServer()
+	go node.accept()
+	return node, nil
+}
+
+// The address the node accepts connections on
+func (node *Node) Addr() string {
+	return node.listener.Addr().String()
+}
+
+// Choose the snapshot algorithm run by the server, before any link is added
+func (node *Node) SetAlgorithm(algorithm SnapshotAlgorithm) {
+	node.run(func() { node.sim.SetAlgorithm(algorithm) })
+}
+
+// Add the link to the server of the node listening on the given address
+func (node *Node) AddOutboundLink(dest string, addr string) {
+	node.run(func() {
+		node.addRemote(dest)
+		node.sim.AddForwardLink(node.server.Id, dest)
+		node.transport.addLink(node.server.Id, dest, addr)
+	})
+}
+
+// Accept the link from the server of another node
+func (node *Node) AddInboundLink(src string) {
+	node.run(func() {
+		node.addRemote(src)
+		node.sim.AddForwardLink(src, node.server.Id)
+	})
+}
+
+// Add a stand-in for a server running in another process
+func (node *Node) addRemote(serverId string) {
+	if _, ok := node.sim.servers[serverId]; !ok {
+		node.sim.AddServer(serverId, 0)
+		node.sim.remote[serverId] = true
+	}
+}
+
+func (node *Node) SendTokens(numTokens int, dest string) {
+	node.run(func() { node.server.SendTokens(numTokens, dest) })
+}
+
+// Start the snapshot of the given ID on the server. The IDs are chosen by the caller,
+// who must not give the same ID to two snapshots started on different nodes.
+func (node *Node) StartSnapshot(snapshotId int) {
+	node.run(func() {
+		node.sim.getSnapshotProgress(snapshotId)
+		node.sim.logger.RecordEvent(node.server, StartSnapshot{node.server.Id, snapshotId})
+		node.server.StartSnapshot(snapshotId)
+	})
+}
+
+// Collect the part of the snapshot recorded by the server of this node.
+// This function blocks until the snapshot process has completed on the server.
+func (node *Node) CollectSnapshot(snapshotId int) *SnapshotState {
+	var progress *SnapshotProgress
+	node.run(func() { progress = node.sim.getSnapshotProgress(snapshotId) })
+	<-progress.done
+	var snap *SnapshotState
+	node.run(func() { snap = node.sim.CollectSnapshot(snapshotId) })
+	return snap
+}
+
+// Return the number of tokens on the server
+func (node *Node) Tokens() int {
+	tokens := 0
+	node.run(func() { tokens = node.server.Tokens })
+	return tokens
+}
+
+// Stop accepting connections and close the links.
+// The messages not written to their connection yet are lost.
+func (node *Node) Close() {
+	close(node.stop)
+	node.listener.Close()
+	node.transport.close()
+	node.done.Wait()
+}
+
+// Run the function on the goroutine of the node and wait for it to return
+func (node *Node) run(f func()) {
+	returned := make(chan bool)
+	node.inbox <- func() {
+		f()
+		close(returned)
+	}
+	<-returned
+}
+
+func (node *Node) runServer() {
+	defer node.done.Done()
+	for {
+		select {
+		case f := <-node.inbox:
+			f()
+		case <-node.stop:
+			return
+		}
+	}
+}
+
+// Accept the connections of the inbound links
+func (node *Node) accept() {
+	defer node.done.Done()
+	for {
+		conn, err := node.listener.Accept()
+		if err != nil {
+			// The listener was closed
+			return
+		}
+		node.done.Add(1)
+		go node.receive(conn)
+	}
+}
+
+// Hand the messages arriving on the connection to the server, in order.
+// The sender of the first message is the server at the other end of the connection.
+// A bad message closes the connection, the node keeps running.
+func (node *Node) receive(conn net.Conn) {
+	defer node.done.Done()
+	defer conn.Close()
+	go func() {
+		<-node.stop
+		conn.Close()
+	}()
+	peer := ""
+	for {
+		frame, err := readFrame(conn)
+		if err != nil {
+			// The other node closed the link, or sent a frame too large
+			return
+		}
+		src, message, err := DecodeMessage(frame)
+		if err != nil {
+			log.Printf("Server %v received a bad message, closing the connection: %v\n", node.server.Id, err)
+			return
+		}
+		if peer == "" {
+			peer = src
+		}
+		if src != peer {
+			log.Printf("Server %v received a message from %v on the link from %v, closing the connection\n",
+				node.server.Id, src, peer)
+			return
+		}
+		select {
+		case node.inbox <- func() {
+			if _, ok := node.server.inboundLinks[src]; !ok {
+				log.Printf("Server %v received a message from %v without a link, closing the connection\n",
+					node.server.Id, src)
+				conn.Close()
+				return
+			}
+			node.sim.deliver(src, node.server, message)
+		}:
+		case <-node.stop:
+			return
+		}
+	}
+}
+
+// Track a snapshot started by a server in another process.
+// Only the local servers are members, see `Node.CollectSnapshot`.
+func (sim *Simulator) trackRemoteSnapshot(snapshotId int) *SnapshotProgress {
+	members := make([]*Server, 0)
+	for _, server := range sim.sortedServers() {
+		if !sim.remote[server.Id] {
+			members = append(members, server)
+		}
+	}
+	progress := &SnapshotProgress{make(map[string]bool), make(chan bool), sim.time, []int{snapshotId}, -1, nil, members}
+	sim.snapshots.Store(snapshotId, progress)
+	return progress
+}
+
+// Merge the parts of a snapshot collected from every node into the snapshot of the whole system
+func MergeSnapshots(parts []*SnapshotState) *SnapshotState {
+	snap := SnapshotState{
+		id:       parts[0].id,
+		tokens:   make(map[string]int),
+		messages: make([]*SnapshotMessage, 0)}
+	for _, part := range parts {
+		for serverId, tokens := range part.tokens {
+			snap.tokens[serverId] = tokens
+		}
+		snap.messages = append(snap.messages, part.messages...)
+	}
+	return &snap
+}
+
+func (t *TCPTransport) addLink(src string, dest string, addr string) {
+	link := &tcpLink{src: src, addr: addr, pending: make([]interface{}, 0)}
+	link.ready = sync.NewCond(&link.lock)
+	t.links[dest] = link
+	go link.write(t.stop)
+}
+
+// Queue the message to be written to the connection of the link. It never blocks,
+// so that two nodes sending to each other cannot wait on each other.
+// The messages sent on a closed link are lost.
+func (t *TCPTransport) Send(link *Link, message interface{}) {
+	l := t.links[link.dest]
+	l.lock.Lock()
+	if !l.closed {
+		l.pending = append(l.pending, message)
+	}
+	l.lock.Unlock()
+	l.ready.Signal()
+}
+
+func (t *TCPTransport) close() {
+	close(t.stop)
+	for _, link := range t.links {
+		link.close()
+	}
+}
+
+// Stop writing to the connection of the link, dropping the messages not written yet
+func (link *tcpLink) close() {
+	link.lock.Lock()
+	link.closed = true
+	link.pending = nil
+	link.lock.Unlock()
+	link.ready.Signal()
+}
+
+// Connect to the destination and write the queued messages to the connection, in order.
+// An error closes the link, the node keeps running.
+func (link *tcpLink) write(stop chan bool) {
+	conn, err := dial(link.addr, stop)
+	if err != nil {
+		log.Printf("Server %v closes the link to %v: %v\n", link.src, link.addr, err)
+		link.close()
+		return
+	}
+	if conn == nil {
+		return
+	}
+	defer conn.Close()
+	for {
+		link.lock.Lock()
+		for len(link.pending) == 0 && !link.closed {
+			link.ready.Wait()
+		}
+		if link.closed {
+			link.lock.Unlock()
+			return
+		}
+		message := link.pending[0]
+		link.pending = link.pending[1:]
+		link.lock.Unlock()
+		frame, err := EncodeMessage(link.src, message)
+		if err == nil {
+			err = writeFrame(conn, frame)
+		}
+		if err != nil {
+			log.Printf("Server %v closes the link to %v, cannot send %v: %v\n", link.src, link.addr, message, err)
+			link.close()
+			return
+		}
+	}
+}
+
+// Connect to the address, retrying until the node there accepts connections.
+// Return no connection and no error if the transport is closed first.
+func dial(addr string, stop chan bool) (net.Conn, error) {
+	deadline := time.Now().Add(dialTimeout)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			return conn, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("cannot connect to %v: %v", addr, err)
+		}
+		select {
+		case <-stop:
+			return nil, nil
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// Write the frame, prefixed by its length
+func writeFrame(w io.Writer, frame []byte) error {
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(frame)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(frame)
+	return err
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header)
+	if size > maxFrameSize {
+		return nil, fmt.Errorf("frame of %v bytes", size)
+	}
+	frame := make([]byte, size)
+	_, err := io.ReadFull(r, frame)
+	return frame, err
+}
@@ -0,0 +1,110 @@
+package lamport
+
+// ==========================================
+//  In-band snapshot termination detection
+// ==========================================
+
+// By default every server tells the simulator when it has finished a snapshot,
+// and the simulator decides when the snapshot is complete. A real deployment has
+// no such oracle, so with `sim.SetInBandTermination(true)` the servers detect
+// termination themselves, with a convergecast along the spanning tree formed by
+// the first-marker parents (`LocalSnapshot.parent`):
+//
+//  - Once a server has received the marker on all of its inbound links, it sends
+//    a `SnapshotReportMessage` naming its outbound neighbors to its parent.
+//  - Every server passes the reports it receives on to its own parent, so each
+//    report goes up the tree once and reaches the initiator.
+//  - The initiator knows the snapshot has terminated when every server it has
+//    heard of (itself and the neighbors named in the reports) has reported.
+//    It then emits the `EndSnapshot` event itself.
+//
+// Links are one-way, so a server may have no link back to its parent, as on a ring.
+// Such a server floods the report instead. A flooded report carries the servers it
+// went through and never goes through one of them again, so no server keeps any state
+// about the reports it has seen. It reaches the initiator, which chandy-lamport
+// already requires to be reachable, possibly more than once.
+//
+// 服务器自己检测快照的结束：沿着第一个 marker 形成的生成树向发起者汇报，而不是依赖模拟器
+
+// Report a snapshot that has completed on this server
+func (server *Server) reportSnapshotComplete(local *LocalSnapshot) {
+	report := SnapshotReportMessage{local.id, server.Id, server.getSortedLinks(), nil}
+	server.handleSnapshotReport(report)
+}
+
+// Callback for when a report is received on this server (or produced by it).
+// The initiator collects the report, every other server passes it on towards the initiator.
+func (server *Server) handleSnapshotReport(report SnapshotReportMessage) {
+	local, ok := server.GetLocalSnapshot(report.snapshotId)
+	if ok && local.initiator {
+		server.collectSnapshotReport(local, report)
+		return
+	}
+	parent := ""
+	if ok {
+		parent = local.parent
+	}
+	server.sendUp(parent, report.route, func(route []string) interface{} {
+		report.route = route
+		return report
+	})
+}
+
+// Send a message of a convergecast to the parent, or flood it where there is no link
+// to the parent (or the message is already flooded), through the servers it has not been
+// through yet. The route is the servers a flooded message went through, nil while it follows
+// the tree, and withRoute returns the message carrying the given route.
+func (server *Server) sendUp(parent string, route []string, withRoute func(route []string) interface{}) {
+	if link, ok := server.outboundLinks[parent]; ok && route == nil {
+		message := withRoute(nil)
+		server.sim.logger.RecordEvent(server, SentMessageEvent{server.Id, link.dest, message})
+		server.send(link, message)
+		return
+	}
+	route = append(append([]string{}, route...), server.Id)
+	message := withRoute(route)
+	for _, dest := range server.getSortedLinks() {
+		if containsServer(route, dest) {
+			continue
+		}
+		link := server.outboundLinks[dest]
+		server.sim.logger.RecordEvent(server, SentMessageEvent{server.Id, link.dest, message})
+		server.send(link, message)
+	}
+}
+
+// Whether every server heard of has reported: this server and the neighbors
+// named in the reports, key = reporting server, value = its outbound neighbors
+func heardFromAll(serverId string, reports map[string][]string) bool {
+	if _, ok := reports[serverId]; !ok {
+		return false
+	}
+	for _, neighbors := range reports {
+		for _, neighbor := range neighbors {
+			if _, ok := reports[neighbor]; !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func containsServer(serverIds []string, serverId string) bool {
+	for _, other := range serverIds {
+		if other == serverId {
+			return true
+		}
+	}
+	return false
+}
+
+// Record a report on the initiator and check whether the snapshot has terminated
+func (server *Server) collectSnapshotReport(local *LocalSnapshot, report SnapshotReportMessage) {
+	local.reports[report.serverId] = report.neighbors
+	if local.terminated || !heardFromAll(server.Id, local.reports) {
+		return
+	}
+	local.terminated = true
+	server.sim.logger.RecordEvent(server, EndSnapshot{server.Id, local.id})
+	server.sim.NotifySnapshotTerminated(local.id)
+}
@@ -6,7 +6,6 @@ import (
 	"log"
 	"path"
 	"reflect"
-	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -26,6 +25,11 @@ const testDir = "test_data"
 // 	  that server, in the form "[serverId] [numTokens]" (e.g. "N1 1")（e.g. 比如）
 // 	- The rest of the lines represent unidirectional links in the form "[src dst]" (e.g. "N1 N2")
 //  -  剩下的行表示单向传播(e.g. "N1 N2")
+// 	- A link may be followed by options in the form "key=value":
+// 	  "order=fifo|random|earliest" sets the order the link delivers messages in (default fifo)
+// 	  "delay=MODEL" sets the delay model of the link, e.g. "delay=fixed:3" (see parseDelayModel)
+// 	  "capacity=N" sets the number of messages the link can hold in flight (default unbounded)
+// 	  "loss=P" and "dup=P" set the probability that the link loses or duplicates a message
 //2
 //n1 1 [serverId] [numTokens]
 //n2 2
@@ -36,45 +40,35 @@ const testDir = "test_data"
 func readTopology(fileName string, sim *Simulator) {
 	b, err := ioutil.ReadFile(path.Join(testDir, fileName))
 	checkError(err)
-	lines := strings.FieldsFunc( //FieldsFunc把b按照 \n 分隔开
-		string(b),
-		func(r rune) bool {
-			return r == '\n'
-		})
-
-	// Must call this before we start logging
-	sim.logger.NewEpoch()
+	parseTopology(string(b), sim)
+}
 
-	// Parse topology(拓扑) from lines
-	numServersLeft := -1
-	for _, line := range lines {
-		// Ignore 忽视    comments 评论
-		fmt.Println("{ top文件的每一行"+line+" }")
-		if strings.HasPrefix(line, "#") {  //判断这一行是否以prefix开头
-			continue
+// Apply the "key=value" options that follow "policy" in a ".events" file
+func readPolicyOptions(options []string, sim *Simulator) {
+	for _, option := range options {
+		kv := strings.SplitN(option, "=", 2)
+		if len(kv) != 2 {
+			log.Fatal("Expected key=value policy option: ", option)
 		}
-		if numServersLeft < 0 {
-			numServersLeft, err = strconv.Atoi(line) //字符串转换为数字
+		switch kv[0] {
+		case "full":
+			policy, err := parseFullLinkPolicy(kv[1])
 			checkError(err)
-			continue
-		}
-		// Otherwise, always expect（期望） 2 tokens
-		parts := strings.Fields(line) //以空白字符切分这一行的字符串
-		if len(parts) != 2 {
-			log.Fatal("Expected 2 tokens in line: ", line)
-		}
-		if numServersLeft > 0 { // severid 和token数的读取
-			// This is a server
-			serverId := parts[0]
-			numTokens, err := strconv.Atoi(parts[1])
+			sim.SetFullLinkPolicy(policy)
+		case "crash":
+			policy, err := parseCrashPolicy(kv[1])
+			checkError(err)
+			sim.SetCrashPolicy(policy)
+		case "partition":
+			policy, err := parsePartitionPolicy(kv[1])
+			checkError(err)
+			sim.SetPartitionPolicy(policy)
+		case "delivery":
+			policy, err := parseDeliveryPolicy(kv[1])
 			checkError(err)
-			sim.AddServer(serverId, numTokens) //模拟器添加一个服务器
-			numServersLeft--
-		} else { //遍历最后两行
-			// This is a link
-			src := parts[0] //遍历发送
-			dest := parts[1]
-			sim.AddForwardLink(src, dest)
+			sim.SetDeliveryPolicy(policy)
+		default:
+			log.Fatal("Unknown policy option: ", option)
 		}
 	}
 }
@@ -87,6 +81,15 @@ func readTopology(fileName string, sim *Simulator) {
 // - "send N1 N2 1" indicates that N1 sends 1 token to N2
 // - "snapshot N2" indicates
 // the beginning of the snapshot process , starting on N2（快照过程的开始，从 N2 开始）
+// - "crash N3" and "recover N3" indicate that N3 crashes and recovers (服务器崩溃与恢复)
+// - "partition N1,N2 | N3,N4" splits the network into groups until "heal" (网络分区与恢复)
+// - "addserver N9 5", "removeserver N9", "addlink N1 N9" and "removelink N1 N9"
+//   change the topology (动态拓扑)
+// - "restore 0" puts the simulator back in the state recorded by snapshot 0,
+//   once it has completed (从快照恢复)
+// - "policy full=drop crash=drop partition=drop delivery=round-robin" sets what the simulator
+//   does with the messages sent on a full link, to a crashed server and across a partition,
+//   and which ready messages it delivers at each time step (策略)
 // Note that concurrent（并发） events are indicated by（表示了） the lack of ticks between the events.
 // 请注意，并发事件由事件之间缺少点
 // This function waits until all the snapshot processes have terminated before returning the snapshots collected.
@@ -131,15 +134,39 @@ func injectEvents(fileName string, sim *Simulator) []*SnapshotState {
 				getSnapshots <- sim.CollectSnapshot(id) //发送SnapshotState 到信道里面
 				log.Printf("getSnapshots 从CollectSnapshot函数获得 %v 快照 \n",getSnapshots)
 			}(snapshotId)
+		case "crash":
+			sim.InjectEvent(CrashEvent{parts[1]})
+		case "recover":
+			sim.InjectEvent(RecoverEvent{parts[1]})
+		case "partition":
+			groups, err := parsePartition(strings.Join(parts[1:], " "))
+			checkError(err)
+			sim.InjectEvent(PartitionEvent{groups})
+		case "heal":
+			sim.InjectEvent(HealEvent{})
+		case "addserver":
+			tokens, err := strconv.Atoi(parts[2])
+			checkError(err)
+			sim.InjectEvent(AddServerEvent{parts[1], tokens})
+		case "removeserver":
+			sim.InjectEvent(RemoveServerEvent{parts[1]})
+		case "addlink":
+			sim.InjectEvent(AddLinkEvent{parts[1], parts[2]})
+		case "removelink":
+			sim.InjectEvent(RemoveLinkEvent{parts[1], parts[2]})
+		case "restore":
+			snapshotId, err := strconv.Atoi(parts[1])
+			checkError(err)
+			sim.InjectEvent(RestoreEvent{snapshotId})
+		case "policy":
+			readPolicyOptions(parts[1:], sim)
 		case "tick":
 			numTicks := 1 //默认tick为1
 			if len(parts) > 1 {
 				numTicks, err = strconv.Atoi(parts[1])
 				checkError(err)
 			}
-			for i := 0; i < numTicks; i++ {
-				sim.Tick()
-			}
+			sim.TickN(numTicks)
 		default:
 			log.Fatal("Unknown event command: ", parts[0])
 		}
@@ -154,14 +181,18 @@ func injectEvents(fileName string, sim *Simulator) []*SnapshotState {
 			snapshots = append(snapshots, snap)
 			numSnapshots--
 		default:
-			sim.Tick() //tick标记号
+			// Jump to the next step with a message to deliver, or
+			// wait for the collection if there is nothing left to deliver
+			if !sim.Step() { //tick标记号
+				snapshots = append(snapshots, <-getSnapshots)
+				numSnapshots--
+			}
 		}
 	}
 
-	// Keep ticking until we're sure that the last message has been delivered
+	// Keep stepping until we're sure that the last message has been delivered
 	//直到收到确认最后一条信息被接收才停止tick
-	for i := 0; i < maxDelay+1; i++ {
-		sim.Tick()
+	for sim.Step() {
 	}
 
 	return snapshots
@@ -178,47 +209,7 @@ func injectEvents(fileName string, sim *Simulator) []*SnapshotState {
 func readSnapshot(fileName string) *SnapshotState {
 	b, err := ioutil.ReadFile(path.Join(testDir, fileName)) //读取文件
 	checkError(err)
-	snapshot := SnapshotState{0, make(map[string]int), make([]*SnapshotMessage, 0)}
-	lines := strings.FieldsFunc(string(b), func(r rune) bool { return r == '\n' }) //根据空格分隔每一行
-	for _, line := range lines {
-		// Ignore comments
-		if strings.HasPrefix(line, "#") {
-			continue
-		}
-		parts := strings.Fields(line)
-		if len(parts) == 1 {
-			// Snapshot ID
-			snapshot.id, err = strconv.Atoi(line)
-			checkError(err)
-		} else if len(parts) == 2 {
-			// Server and its tokens
-			serverId := parts[0]
-			numTokens, err := strconv.Atoi(parts[1])
-			checkError(err)
-			snapshot.tokens[serverId] = numTokens
-		} else if len(parts) == 3 {
-			// Src, dest and message
-			src := parts[0]
-			dest := parts[1]
-			messageString := parts[2]
-			var message interface{}
-			if strings.Contains(messageString, "token") {
-				pattern := regexp.MustCompile(`[0-9]+`)
-				matches := pattern.FindStringSubmatch(messageString)
-				if len(matches) != 1 {
-					log.Fatal("Unable to parse token message: ", messageString)
-				}
-				numTokens, err := strconv.Atoi(matches[0])
-				checkError(err)
-				message = TokenMessage{numTokens}
-			} else {
-				log.Fatal("Unknown message: ", messageString)
-			}
-			snapshot.messages =
-				append(snapshot.messages, &SnapshotMessage{src, dest, message})
-		}
-	}
-	return &snapshot
+	return parseSnapshot(string(b))
 }
 
 // Helper function to pretty print the tokens in the given snapshot state
@@ -322,26 +313,34 @@ func sortSnapshots(snaps []*SnapshotState) {
 	})
 }
 
+// Return the total number of tokens recorded in the snapshot,
+// on the servers and in the messages in-flight
+func snapshotTokens(snap *SnapshotState) int {
+	snapTokens := 0
+	// Add tokens recorded on servers
+	for _, tok := range snap.tokens {
+		snapTokens += tok
+	}
+	// Add tokens from messages in-flight
+	for _, message := range snap.messages {
+		switch msg := message.message.(type) {
+		case TokenMessage:
+			snapTokens += msg.numTokens
+		}
+	}
+	return snapTokens
+}
+
 // Verify that the total number of tokens recorded in the snapshot
 // preserves（保存） the number of tokens in the system
 func checkTokens(sim *Simulator, snapshots []*SnapshotState) {
-	expectedTokens := 0
-	for _, server := range sim.servers {
-		expectedTokens += server.Tokens
-	}
+	expectedTokens := simulatorTokens(sim)
 	for _, snap := range snapshots {
-		snapTokens := 0
-		// Add tokens recorded on servers
-		for _, tok := range snap.tokens {
-			snapTokens += tok
-		}
-		// Add tokens from messages in-flight
-		for _, message := range snap.messages {
-			switch msg := message.message.(type) {
-			case TokenMessage:
-				snapTokens += msg.numTokens
-			}
+		if snap.Failed() {
+			// A failed snapshot records no state
+			continue
 		}
+		snapTokens := snapshotTokens(snap)
 		if expectedTokens != snapTokens {
 			log.Fatalf("Snapshot %v: simulator has %v tokens, snapshot has %v:\n%v\n%v",
 				snap.id,
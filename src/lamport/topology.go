@@ -0,0 +1,232 @@
+package lamport
+
+import (
+	"fmt"
+	"log"
+)
+
+// ====================
+//  Dynamic topology
+// ====================
+
+// Servers and links can be added and removed while the simulation runs:
+//
+//  - A snapshot only covers the servers in place when it started, its members. Servers
+//    added later take no part in it, and tokens moved to them are not part of it.
+//  - A link added while a snapshot is in progress carries the marker of the snapshot if
+//    its source has recorded it, so the destination does not wait for it forever. If only
+//    the destination has recorded the snapshot, the source records it first, so that
+//    nothing it sends on the new link crosses the cut.
+//  - The tokens of the messages still queued on a removed link go back to its source.
+//    Tokens sent before the source recorded a snapshot count in its recorded state, as if
+//    they had never been sent. The destination stops waiting for a marker on the link.
+//  - A removed server leaves with its tokens, and the snapshots it had not completed fail.
+//
+// Only Chandy-Lamport supports changes while a snapshot is in progress.
+//
+// 运行时动态增删服务器和信道
+
+// An event parsed from the .events files that adds a server
+type AddServerEvent struct {
+	serverId string
+	tokens   int
+}
+
+func (m AddServerEvent) String() string {
+	return fmt.Sprintf("%v joined with %v tokens", m.serverId, m.tokens)
+}
+
+// An event parsed from the .events files that removes a server and its links
+type RemoveServerEvent struct {
+	serverId string
+}
+
+func (m RemoveServerEvent) String() string {
+	return fmt.Sprintf("%v left", m.serverId)
+}
+
+// An event parsed from the .events files that adds a link
+type AddLinkEvent struct {
+	src  string
+	dest string
+}
+
+func (m AddLinkEvent) String() string {
+	return fmt.Sprintf("link %v -> %v added", m.src, m.dest)
+}
+
+// An event parsed from the .events files that removes a link
+type RemoveLinkEvent struct {
+	src  string
+	dest string
+}
+
+func (m RemoveLinkEvent) String() string {
+	return fmt.Sprintf("link %v -> %v removed", m.src, m.dest)
+}
+
+// Tokens given back to the sender because their link was removed
+type RefundEvent struct {
+	src       string
+	dest      string
+	numTokens int
+}
+
+func (m RefundEvent) String() string {
+	return fmt.Sprintf("%v got back %v tokens sent to %v", m.src, m.numTokens, m.dest)
+}
+
+// Return the snapshots that have neither completed nor failed, in the order they started
+func (sim *Simulator) snapshotsInProgress() []*SnapshotProgress {
+	inProgress := make([]*SnapshotProgress, 0)
+	for id := 0; id < sim.nextSnapshotId; id++ {
+		progress := sim.getSnapshotProgress(id)
+		// Merged snapshots share their progress
+		if progress.finished < 0 && progress.ids[0] == id {
+			inProgress = append(inProgress, progress)
+		}
+	}
+	return inProgress
+}
+
+func (sim *Simulator) requireChandyLamport(change string) {
+	if sim.algorithm != ChandyLamport {
+		log.Fatalf("Cannot %v during a snapshot with %v, only with %v\n", change, sim.algorithm, ChandyLamport)
+	}
+}
+
+// Whether the server was in place when the snapshot started
+func (progress *SnapshotProgress) hasMember(serverId string) bool {
+	for _, server := range progress.members {
+		if server.Id == serverId {
+			return true
+		}
+	}
+	return false
+}
+
+// Let the snapshots in progress account for a link added between two of their members
+func (sim *Simulator) linkAdded(link *Link) {
+	src := sim.servers[link.src]
+	dest := sim.servers[link.dest]
+	for _, progress := range sim.snapshotsInProgress() {
+		if !progress.hasMember(src.Id) || !progress.hasMember(dest.Id) {
+			continue
+		}
+		sim.requireChandyLamport("add a link")
+		if local, ok := dest.getMergedSnapshot(progress.ids); ok && !local.complete {
+			// The destination waits for the marker on the new link too
+			local.recording[src.Id] = true
+		}
+		if local, ok := src.getMergedSnapshot(progress.ids); ok {
+			marker := MarkerMessage{local.id, local.epoch}
+			sim.logger.RecordEvent(src, SentMessageEvent{src.Id, dest.Id, marker})
+			src.send(link, marker)
+		} else if local, ok := dest.getMergedSnapshot(progress.ids); ok {
+			// Records the snapshot and sends its marker on every link, the new one included
+			if sim.mergeSnapshots {
+				src.joinEpoch(local.id, local.epoch, dest.Id)
+			} else {
+				src.recordSnapshot(local.id, local.epoch, dest.Id)
+			}
+		}
+	}
+}
+
+// Remove the link between two servers, giving the tokens still queued on it back to the source
+func (sim *Simulator) RemoveLink(srcId string, destId string) {
+	sim.requireSimulated("RemoveLink")
+	link := sim.getLink(srcId, destId)
+	src := sim.servers[srcId]
+	dest := sim.servers[destId]
+	if len(sim.snapshotsInProgress()) > 0 {
+		sim.requireChandyLamport("remove a link")
+	}
+	messages := sim.undelivered(link)
+	for i, message := range messages {
+		token, ok := message.(TokenMessage)
+		if !ok {
+			continue
+		}
+		// The markers queued after the tokens belong to snapshots
+		// the source recorded after sending them
+		for _, later := range messages[i+1:] {
+			if marker, ok := later.(MarkerMessage); ok {
+				if local, ok := src.GetLocalSnapshot(marker.snapshotId); ok {
+					src.creditSnapshot(local, token.numTokens)
+				}
+			}
+		}
+		src.Tokens += token.numTokens
+		sim.logger.RecordEvent(src, RefundEvent{srcId, destId, token.numTokens})
+	}
+	delete(src.outboundLinks, destId)
+	src.sortedLinks = nil
+	delete(dest.inboundLinks, srcId)
+	// A link added again later starts counting from zero, see laiyang.go
+	delete(src.sent, destId)
+	delete(dest.received, srcId)
+	// The destination no longer waits for a marker on the link
+	for _, id := range dest.recorded {
+		if local, ok := dest.GetLocalSnapshot(id); ok && !local.complete {
+			delete(local.recording, srcId)
+			dest.checkSnapshotComplete(local)
+		}
+	}
+}
+
+// Add tokens to the recorded state of the local snapshot
+func (server *Server) creditSnapshot(local *LocalSnapshot, numTokens int) {
+	local.tokens += numTokens
+	local.unchanged = false
+	// The incremental snapshots based on this one no longer have the same state
+	for _, id := range server.recorded {
+		if other, ok := server.GetLocalSnapshot(id); ok && other.base == local.id {
+			other.unchanged = false
+		}
+	}
+}
+
+// Return the messages sent on the link that its destination has not handled yet,
+// in the order they were sent
+func (sim *Simulator) undelivered(link *Link) []interface{} {
+	messages := make([]interface{}, 0)
+	if sim.reliable {
+		// The reliable delivery layer keeps every packet the destination has not handled,
+		// while the link itself may hold extra copies of them, see reliable.go
+		for _, packet := range link.transport.unacked {
+			if packet.seq >= link.transport.expected {
+				messages = append(messages, packet.message)
+			}
+		}
+		return messages
+	}
+	for _, item := range link.events.Items() {
+		messages = append(messages, item.(SendMessageEvent).message)
+	}
+	for _, item := range link.backlog.Items() {
+		messages = append(messages, item.(SendMessageEvent).message)
+	}
+	return messages
+}
+
+// Remove the server and its links. It leaves with its tokens.
+func (sim *Simulator) RemoveServer(serverId string) {
+	sim.requireSimulated("RemoveServer")
+	server, ok := sim.servers[serverId]
+	if !ok {
+		log.Fatalf("Server %v does not exist\n", serverId)
+	}
+	for _, progress := range sim.snapshotsInProgress() {
+		if progress.hasMember(serverId) && !server.completedSnapshot(progress) {
+			sim.failSnapshot(progress, server)
+		}
+	}
+	for _, dest := range server.getSortedLinks() {
+		sim.RemoveLink(serverId, dest)
+	}
+	for _, src := range getSortedKeys(server.inboundLinks) {
+		sim.RemoveLink(src, serverId)
+	}
+	delete(sim.servers, serverId)
+}
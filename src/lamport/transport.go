@@ -0,0 +1,45 @@
+package lamport
+
+// ===========
+//  Transport
+// ===========
+
+// The servers never touch the links directly: every message they send goes through
+// the transport of the simulator, and the transport hands it to `sim.deliver` at the
+// destination, which calls `HandlePacket`. So `SendTokens`, `SendToNeighbors` and
+// `HandlePacket` work the same whether the link is
+//   - the queue of the link in the simulator, the default, which may lose or duplicate
+//     messages (faults.go)
+//   - a goroutine forwarding the messages after a wall-clock delay (live.go)
+//   - a TCP connection to a server running in another process (tcp.go)
+//
+// 传输层：消息经由 Transport 到达目的服务器，信道队列只是其中一种实现
+
+type Transport interface {
+	// Put the message on the link. The transport must deliver the messages
+	// of a link in the order they were sent, unless the link says otherwise.
+	Send(link *Link, message interface{})
+}
+
+// The transport of the simulator: messages wait in the queue of their link
+// until the scheduler delivers them, see scheduler.go
+type queueTransport struct {
+	sim *Simulator
+}
+
+// Put a message on the link through the transport of the simulator
+func (sim *Simulator) transmit(link *Link, message interface{}) {
+	sim.transport.Send(link, message)
+}
+
+// Put a message on the queue of the link, where it may be lost or duplicated
+func (t queueTransport) Send(link *Link, message interface{}) {
+	sim := t.sim
+	e := SendMessageEvent{link.src, link.dest, message, sim.GetReceiveTime(link)}
+	if sim.lose(link, e) {
+		return
+	}
+	link.events.Push(e)
+	sim.schedule(sim.servers[link.src], e.receiveTime)
+	sim.duplicate(link, e)
+}
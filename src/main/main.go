@@ -1,11 +1,92 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"lamport"
+	"log"
+	"os"
+	"strconv"
+	"time"
 )
 
+const usage = `Usage:
+  main cluster [-algorithm NAME] [-unit DURATION] TOPFILE EVENTSFILE OUTDIR
+      run every server of the topology in its own process on loopback ports,
+      replay the events and write the snapshots to OUTDIR as ".snap" files
+  main node ID TOKENS ALGORITHM
+      run a single server, started by "cluster"
+`
+
 func main()  {
-	fmt.Println()
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	switch os.Args[1] {
+	case "cluster":
+		runCluster(os.Args[2:])
+	case "node":
+		runNode(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+// 本地集群：每个服务器一个进程
+func runCluster(args []string) {
+	flags := flag.NewFlagSet("cluster", flag.ExitOnError)
+	algorithmName := flags.String("algorithm", lamport.ChandyLamport.String(), "snapshot algorithm run by the servers")
+	unit := flags.Duration("unit", 10*time.Millisecond, "wall-clock duration of a tick")
+	flags.Parse(args)
+	if flags.NArg() != 3 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	algorithm, err := lamport.ParseAlgorithm(*algorithmName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		log.Fatal(err)
+	}
+	cluster, err := lamport.StartCluster(flags.Arg(0), algorithm, *unit, executable)
+	if err != nil {
+		log.Fatal(err)
+	}
+	snapshots, err := cluster.Replay(flags.Arg(1))
+	cluster.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.MkdirAll(flags.Arg(2), 0755); err != nil {
+		log.Fatal(err)
+	}
+	if err := lamport.WriteSnapshots(flags.Arg(2), flags.Arg(1), snapshots); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Wrote %v snapshot(s) to %v\n", len(snapshots), flags.Arg(2))
+}
+
+// 集群中的一个服务器进程
+func runNode(args []string) {
+	if len(args) != 3 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	tokens, err := strconv.Atoi(args[1])
+	if err != nil {
+		log.Fatal(err)
+	}
+	algorithm, err := lamport.ParseAlgorithm(args[2])
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := lamport.ServeNode(args[0], tokens, algorithm, os.Stdout); err != nil {
+		log.Fatal(err)
+	}
 }
 
 func test3(){
@@ -21,4 +102,3 @@ func test3(){
 	//fmt.Println(snapshots);
 	fmt.Println("你好啊")
 }
-